@@ -0,0 +1,95 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Decisions recorded in the -csv-log.
+const (
+	decisionInjected      = "injected"
+	decisionSkipped       = "skipped"
+	decisionFailed        = "failed"
+	decisionFailOpen      = "fail-open"
+	decisionSecretMissing = "secret-missing"
+	decisionDryRun        = "dry-run"
+)
+
+var csvHeader = []string{"timestamp", "namespace", "object", "service_account", "decision"}
+
+// decisions is set when -csv-log is enabled.
+var decisions *decisionLog
+
+// decisionLog appends a CSV record for every object the initializer decides
+// on, for clusters without Prometheus.
+type decisionLog struct {
+	mu sync.Mutex
+	w  *csv.Writer
+}
+
+// newDecisionLog returns a decisionLog writing to w, starting with the CSV
+// header if header is set.
+func newDecisionLog(w io.Writer, header bool) (*decisionLog, error) {
+	l := &decisionLog{w: csv.NewWriter(w)}
+	if header {
+		l.w.Write(csvHeader)
+		l.w.Flush()
+		if err := l.w.Error(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// openDecisionLog opens the CSV file at path for appending, writing the
+// header if the file is new or empty.
+func openDecisionLog(path string) (*decisionLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return newDecisionLog(f, fi.Size() == 0)
+}
+
+// record appends a record and flushes it, so the file is complete even if
+// the initializer is killed.
+func (l *decisionLog) record(now time.Time, namespace, object, serviceAccount, decision string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write([]string{now.UTC().Format(time.RFC3339), namespace, object, serviceAccount, decision})
+	l.w.Flush()
+	return l.w.Error()
+}
+
+// recordDecision records the decision taken on obj, described as object
+// (e.g. "pod/foo"), if -csv-log is enabled.
+func recordDecision(obj metav1.Object, object, serviceAccount, decision string) {
+	if decisions == nil {
+		return
+	}
+	if err := decisions.record(time.Now(), obj.GetNamespace(), object, serviceAccount, decision); err != nil {
+		log.Printf("failed to write -csv-log record for %s: %+v", object, err)
+	}
+}
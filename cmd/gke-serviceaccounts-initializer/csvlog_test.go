@@ -0,0 +1,79 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_openDecisionLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csvlog")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "decisions.csv")
+
+	now := time.Unix(1500000000, 0)
+	for i := 0; i < 2; i++ {
+		l, err := openDecisionLog(file)
+		assert.NoError(t, err)
+		assert.NoError(t, l.record(now, "default", "pod/foo", "sa-1", decisionInjected))
+	}
+
+	data, err := ioutil.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "timestamp,namespace,object,service_account,decision\n"+
+		"2017-07-14T02:40:00Z,default,pod/foo,sa-1,injected\n"+
+		"2017-07-14T02:40:00Z,default,pod/foo,sa-1,injected\n", string(data),
+		"the header is only written to a new file")
+}
+
+func Test_initializePod_csvLog(t *testing.T) {
+	defer func(l *decisionLog) { decisions = l }(decisions)
+	var buf bytes.Buffer
+	var err error
+	decisions, err = newDecisionLog(&buf, true)
+	assert.NoError(t, err)
+
+	newPod := func(name string, annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "csv-log", Annotations: annotations,
+				Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+					{Name: "serviceaccounts.cloud.google.com"}}}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	}
+	injected := newPod("injected", map[string]string{"iam.cloud.google.com/service-account": "sa-1"})
+	skipped := newPod("skipped", nil)
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "sa-1", Namespace: "csv-log"}}
+	clientset := fake.NewSimpleClientset(injected, skipped, secret)
+
+	initializePod(injected, clientset)
+	initializePod(skipped, clientset)
+
+	rows, err := csv.NewReader(&buf).ReadAll()
+	assert.NoError(t, err)
+	if assert.Len(t, rows, 3) {
+		assert.Equal(t, csvHeader, rows[0])
+		assert.Equal(t, []string{"csv-log", "pod/injected", "sa-1", "injected"}, rows[1][1:])
+		assert.Equal(t, []string{"csv-log", "pod/skipped", "", "skipped"}, rows[2][1:])
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const dumpSuffix = ".json"
+
+// dumpPod writes the pod before and after injection as JSON files to dir,
+// named after now so that they sort oldest first, then deletes the oldest
+// dumps beyond maxFiles.
+func dumpPod(dir string, orig, modified *corev1.Pod, now time.Time, maxFiles int) error {
+	prefix := fmt.Sprintf("%020d-%s-%s", now.UnixNano(), orig.GetNamespace(), orig.GetName())
+	for suffix, pod := range map[string]*corev1.Pod{"-before": orig, "-after": modified} {
+		data, err := json.MarshalIndent(pod, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal pod: %+v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, prefix+suffix+dumpSuffix), data, 0600); err != nil {
+			return err
+		}
+	}
+	return pruneDumps(dir, maxFiles)
+}
+
+// pruneDumps deletes the oldest dump files in dir so at most maxFiles remain.
+func pruneDumps(dir string, maxFiles int) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), dumpSuffix) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	for len(names) > maxFiles {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
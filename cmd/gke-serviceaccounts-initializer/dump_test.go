@@ -0,0 +1,50 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_dumpPod(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	orig := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+	modified := orig.DeepCopy()
+	modified.Spec.Volumes = []corev1.Volume{{Name: "gcp-sa-1"}}
+
+	start := time.Unix(1500000000, 0)
+	assert.NoError(t, dumpPod(dir, orig, modified, start, 4))
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Len(t, files, 2)
+	after, err := ioutil.ReadFile(filepath.Join(dir, "01500000000000000000-default-foo-after.json"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(after), "gcp-sa-1")
+
+	for i := 1; i <= 2; i++ {
+		assert.NoError(t, dumpPod(dir, orig, modified, start.Add(time.Duration(i)*time.Second), 4))
+	}
+	files, _ = filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Len(t, files, 4, "oldest dumps are pruned")
+	_, err = os.Stat(filepath.Join(dir, "01500000000000000000-default-foo-before.json"))
+	assert.True(t, os.IsNotExist(err), "first dump was pruned")
+}
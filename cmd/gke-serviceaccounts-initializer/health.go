@@ -0,0 +1,87 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// injectionInfo is the resolved configuration served at /info, for operators
+// to check what the initializer injects. It must not carry any secret.
+type injectionInfo struct {
+	Version          string   `json:"version"`
+	MountPath        string   `json:"mountPath"`
+	EnvName          string   `json:"envName"`
+	Annotation       string   `json:"annotation"`
+	CredentialMode   string   `json:"credentialMode"`
+	WatchedResources []string `json:"watchedResources"`
+}
+
+// resolvedInfo returns the injectionInfo of the flags in effect. informed
+// lists the resources initialized from informers; those of the listers that
+// were started are added.
+func resolvedInfo(informed []string) injectionInfo {
+	watched := append([]string(nil), informed...)
+	if serviceAccountLister != nil {
+		watched = append(watched, "serviceaccounts")
+	}
+	if nodeLister != nil {
+		watched = append(watched, "nodes")
+	}
+	if secretLister != nil {
+		watched = append(watched, "secrets")
+	}
+	if configMapLister != nil {
+		watched = append(watched, "configmaps")
+	}
+	return injectionInfo{
+		Version:          version,
+		MountPath:        *baseMountPath,
+		EnvName:          *credentialsEnvName,
+		Annotation:       annotation,
+		CredentialMode:   *credentialMode,
+		WatchedResources: watched,
+	}
+}
+
+// healthHandler serves /healthz, which succeeds as soon as the process is up,
+// /readyz, which only succeeds once synced reports the pod informer's cache
+// as warm, and /info, which returns info as JSON.
+func healthHandler(synced func() bool, info injectionInfo) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !synced() {
+			http.Error(w, "informer cache not synced", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			log.Printf("failed to write /info: %+v", err)
+		}
+	})
+	return mux
+}
+
+// serveHealth serves the health endpoints on addr.
+func serveHealth(addr string, synced func() bool, info injectionInfo) {
+	log.Printf("Serving health checks on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, healthHandler(synced, info)))
+}
@@ -0,0 +1,60 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_healthHandler(t *testing.T) {
+	var synced bool
+	handler := healthHandler(func() bool { return synced }, injectionInfo{})
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, get("/healthz"))
+	assert.Equal(t, http.StatusServiceUnavailable, get("/readyz"))
+
+	synced = true
+	assert.Equal(t, http.StatusOK, get("/healthz"))
+	assert.Equal(t, http.StatusOK, get("/readyz"))
+}
+
+func Test_healthHandler_info(t *testing.T) {
+	defer func(m, e, c string) { *baseMountPath, *credentialsEnvName, *credentialMode = m, e, c }(
+		*baseMountPath, *credentialsEnvName, *credentialMode)
+	*baseMountPath = "/var/run/gcp"
+	*credentialsEnvName = "GOOGLE_APPLICATION_CREDENTIALS"
+	*credentialMode = "secret"
+
+	handler := healthHandler(func() bool { return true }, resolvedInfo([]string{"pods", "jobs"}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/info", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var got map[string]interface{}
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &got))
+	assert.Equal(t, "/var/run/gcp", got["mountPath"])
+	assert.Equal(t, "GOOGLE_APPLICATION_CREDENTIALS", got["envName"])
+	assert.Equal(t, "iam.cloud.google.com/service-account", got["annotation"])
+	assert.Equal(t, "secret", got["credentialMode"])
+	assert.Equal(t, []interface{}{"pods", "jobs"}, got["watchedResources"])
+}
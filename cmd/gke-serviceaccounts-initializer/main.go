@@ -12,38 +12,351 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
-	"log"
+	"hash/fnv"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	log "github.com/sirupsen/logrus"
+	appsv1beta1 "k8s.io/api/apps/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
 	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/client-go/util/workqueue"
 )
 
 const (
-	annotation       = "iam.cloud.google.com/service-account"
+	annotationPrefix      = "iam.cloud.google.com/"
+	annotation            = annotationPrefix + "service-account"
+	envAnnotation         = annotationPrefix + "env." // + container name
+	injectAnnotation      = annotationPrefix + "inject"
+	volumeAnnotation      = annotationPrefix + "volume-name"
+	propagationAnnotation = annotationPrefix + "mount-propagation"
+	secretKeyAnnotation   = annotationPrefix + "secret-key"
+	secretKeysAnnotation  = annotationPrefix + "secret-keys"
+	writableAnnotation    = annotationPrefix + "writable-copy"
+	inlineAnnotation      = annotationPrefix + "inline-credentials"
+	initAnnotation        = annotationPrefix + "inject-init-containers"
+	containersAnnotation  = annotationPrefix + "containers"
+	profileAnnotation     = annotationPrefix + "profile"
+	// legacyAnnotation is the deprecated name of annotation, still accepted
+	// when annotation is not set.
+	legacyAnnotation = annotationPrefix + "account-name"
+	// versionAnnotation records the version of the initializer that
+	// injected the pod.
+	versionAnnotation = annotationPrefix + "injector-version"
+	// workloadIdentityAnnotation binds a Kubernetes ServiceAccount to a GCP
+	// service account with Workload Identity.
+	workloadIdentityAnnotation = "iam.gke.io/gcp-service-account"
+
 	initializerName  = "serviceaccounts.cloud.google.com"
 	defaultNamespace = "default"
 	resyncPeriod     = 30 * time.Second
+	componentName    = "gke-serviceaccounts-initializer"
+
+	// secretLookupTTL is how long secretExists caches a lookup.
+	secretLookupTTL = 30 * time.Second
+
+	// maxEventPatchLength bounds the patch included in -patch-events Events.
+	maxEventPatchLength = 1024
 
 	secretMountPath    = "/var/run/secrets/gcp/"
 	serviceAccountFile = "key.json"
+
+	credentialsEnv = "GOOGLE_APPLICATION_CREDENTIALS"
+	// credentialsJSONSuffix is appended to each credentials env var name to
+	// name the variable the key itself is passed in, e.g.
+	// GOOGLE_APPLICATION_CREDENTIALS_JSON.
+	credentialsJSONSuffix = "_JSON"
+
+	// serviceAccountTokenPath is where the ServiceAccount admission plugin
+	// mounts the Kubernetes API token of the pod's ServiceAccount.
+	serviceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// Virtual Kubelet nodes carry this label. Secret volumes are not
+	// reliably supported on them, so credentials are injected as env.
+	virtualNodeLabel      = "type"
+	virtualNodeLabelValue = "virtual-kubelet"
+
+	// expiryMonitorName names the sidecar added with -expiry-monitor-image;
+	// injected pods carrying it are labeled expiryMonitorLabel=true so
+	// monitoring can select them.
+	expiryMonitorName  = "credential-expiry-monitor"
+	expiryMonitorLabel = annotationPrefix + "expiry-monitor"
+
+	// Pods annotated writableAnnotation=true get a copy of the key on an
+	// emptyDir, made by the copyContainerName init container which mounts
+	// the emptyDir at copyTargetPath.
+	copyContainerName = "gcp-credentials-copy"
+	copyTargetPath    = "/gcp-credentials"
+
+	cloudSDKEnvPrefix = "CLOUDSDK_"
+
+	regionEnv = "GCP_REGION"
+	zoneEnv   = "GCP_ZONE"
+
+	// Node topology labels, current and pre-1.17 (deprecated) forms.
+	regionLabel           = "topology.kubernetes.io/region"
+	zoneLabel             = "topology.kubernetes.io/zone"
+	deprecatedRegionLabel = "failure-domain.beta.kubernetes.io/region"
+	deprecatedZoneLabel   = "failure-domain.beta.kubernetes.io/zone"
+
+	// injectionConditionType is the pod condition recorded with
+	// -status-condition.
+	injectionConditionType corev1.PodConditionType = "InjectionApplied"
+
+	envInjectAppend  = "append"
+	envInjectPrepend = "prepend"
+
+	existingEnvSkip      = "skip"
+	existingEnvOverwrite = "overwrite"
+	// existingEnvMount keeps the existing env var and mounts the key at the
+	// path it names.
+	existingEnvMount = "mount"
+
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	credentialModeSecret           = "secret"
+	credentialModeWorkloadIdentity = "workload-identity"
+
+	metricsAuthNone  = "none"
+	metricsAuthToken = "token"
+
+	authModeAuto       = "auto"
+	authModeInCluster  = "in-cluster"
+	authModeKubeconfig = "kubeconfig"
+)
+
+var (
+	// knownAnnotations and knownAnnotationPrefixes list every annotation
+	// under annotationPrefix that the initializer understands.
+	knownAnnotations = []string{annotation, legacyAnnotation, injectAnnotation,
+		volumeAnnotation, propagationAnnotation, secretKeyAnnotation, secretKeysAnnotation,
+		writableAnnotation, inlineAnnotation, initAnnotation, containersAnnotation,
+		profileAnnotation, versionAnnotation}
+	knownAnnotationPrefixes = []string{envAnnotation}
+)
+
+var (
+	disableEnvInjection = flag.Bool("disable-env-injection", false,
+		"only mount the key, without setting -credentials-env-name or any other env var, "+
+			"except on Virtual Kubelet nodes where the key can only be passed as env")
+	maxPendingInitializers = flag.Int("max-pending-initializers", 64,
+		"objects with more pending initializers than this are skipped as misconfigured; 0 disables the check")
+	maxInjectedVolumes = flag.Int("max-injected-volumes", 0,
+		"maximum number of service account secret volumes injected per object; accounts requested beyond it "+
+			"are dropped, the first ones kept; 0 disables the cap")
+	inlineCredentials = flag.Bool("inline-credentials", false,
+		"inject the key as <-credentials-env-name>"+credentialsJSONSuffix+" sourced from the secret instead of mounting it, "+
+			"unless overridden by the "+inlineAnnotation+" annotation")
+	profilesFile = flag.String("profiles-file", "",
+		"YAML file defining the profiles pods select with the "+profileAnnotation+" annotation")
+	transformPlugin = flag.String("transform-plugin", "",
+		"if set, Go plugin (.so) whose Mutate(*v1.Pod) function is run on every pod after injection")
+	csvLog = flag.String("csv-log", "",
+		"if set, CSV file to append a record to for every object processed, for clusters without Prometheus")
+	dumpDir = flag.String("dump-dir", "",
+		"if set, directory to write each injected pod to as JSON, before and after injection, for debugging")
+	dumpMaxFiles = flag.Int("dump-max-files", 100,
+		"maximum number of files kept in -dump-dir; the oldest are deleted first")
+	requireSecret = flag.Bool("require-secret", false,
+		"leave pods whose secret does not exist pending instead of injecting it anyway")
+	maxSecretLookups = flag.Int("max-concurrent-secret-lookups", 4,
+		"maximum number of secrets looked up on the API server at once, so bursts of pods do not overload it")
+	healthAddr = flag.String("health-addr", "",
+		"if set, address (e.g. :8080) to serve /healthz, /readyz and the resolved config at /info on")
+	metricsAddr = flag.String("metrics-addr", "",
+		"if set, address (e.g. :9090) to serve Prometheus metrics on at /metrics")
+	metricsAuth = flag.String("metrics-auth", metricsAuthNone,
+		"how /metrics scrapes are authenticated (none|token); token requires the bearer token in -metrics-token-file")
+	metricsTokenFile = flag.String("metrics-token-file", "",
+		"file (e.g. a mounted secret) holding the bearer token scrapes must present with -metrics-auth=token")
+	logFormat = flag.String("log-format", logFormatText,
+		"log output format (text|json); json logs carry pod, namespace, serviceAccount and action fields")
+	authMode = flag.String("auth-mode", authModeAuto,
+		"how to authenticate to the API server (in-cluster|kubeconfig|auto); auto falls back to kubeconfig")
+	envInjectOrder = flag.String("env-inject-order", envInjectAppend,
+		"where injected env vars are placed in a container's env list (append|prepend)")
+	injectAllContainers = flag.Bool("inject-all-containers", false,
+		"inject every eligible container instead of only the first one (and those named in "+envAnnotation+"<container> annotations)")
+	credentialsEnvName = flag.String("credentials-env-name", credentialsEnv,
+		"comma-separated names of the env vars set to the key path, overridable per container with "+envAnnotation+"<container>")
+	existingCredentialsEnv = flag.String("existing-credentials-env", existingEnvSkip,
+		"what to do with a container that already sets the credentials env var (skip|overwrite|mount); "+
+			"mount keeps it and mounts the key at the path it names")
+	watchServiceAccounts = flag.Bool("watch-serviceaccounts", false,
+		"inject pods whose Kubernetes ServiceAccount carries the "+annotation+" annotation")
+	credentialMode = flag.String("credential-mode", credentialModeSecret,
+		"how annotated pods get credentials (secret|workload-identity); workload-identity runs them as the "+
+			"Kubernetes ServiceAccount named like the secret instead of mounting it")
+	skipWorkloadIdentity = flag.Bool("skip-workload-identity", false,
+		"do not inject pods whose Kubernetes ServiceAccount carries the "+workloadIdentityAnnotation+
+			" annotation, as Workload Identity already provides their credentials")
+	cleanupStale = flag.Duration("cleanup-stale", 0,
+		"if non-zero, remove this initializer (without injecting) from pods pending it for longer than this, then exit")
+	strictAnnotations = flag.Bool("strict-annotation", false,
+		"skip injection into pods carrying unrecognized "+annotationPrefix+" annotations instead of only warning")
+	patchEvents = flag.Bool("patch-events", false,
+		"record the (truncated) patch applied to each pod as a Kubernetes Event")
+	shard = flag.Int("shard", 0,
+		"index of the shard of pods this replica processes")
+	totalShards = flag.Int("total-shards", 1,
+		"number of replicas pods are sharded across by UID")
+	targetContainerPort = flag.Int("target-container-port", 0,
+		"if non-zero, only inject into containers that declare this container port")
+	statusCondition = flag.Bool("status-condition", false,
+		"record the injection outcome as an "+string(injectionConditionType)+" condition in the pod status")
+	targetImageSubstring = flag.String("target-image-substring", "",
+		"if set, only inject into containers whose image contains this substring")
+	initialSyncQPS = flag.Float64("initial-sync-qps", 0,
+		"if non-zero, max pods per second processed from the backlog found at startup")
+	namespacePriority = flag.String("namespace-priorities", "",
+		"comma-separated namespace=priority pairs (e.g. kube-system=10); pending pods of higher priority "+
+			"namespaces are initialized first, unlisted namespaces have priority 0")
+	denyPrivileged = flag.Bool("deny-privileged", false,
+		"do not inject credentials into privileged containers")
+	injectTopologyEnv = flag.Bool("inject-topology-env", false,
+		"inject GCP_REGION and GCP_ZONE from the topology labels of the node the pod is bound or pinned to")
+	maxAnnotationLength = flag.Int("max-annotation-length", validation.DNS1123SubdomainMaxLength,
+		"maximum length of "+annotationPrefix+" annotation values; pods exceeding it are not injected")
+	failOpen = flag.Bool("fail-open", false,
+		"if the injection patch is rejected, remove the initializer without injecting so the pod can start")
+	reconcileInterval = flag.Duration("reconcile-interval", 0,
+		"if non-zero, how often to re-inject StatefulSets, DaemonSets, Jobs and CronJobs whose injection was removed")
+	minTerminationGracePeriod = flag.Int64("min-termination-grace-period", 0,
+		"if non-zero, raise the terminationGracePeriodSeconds of injected pods to at least this many seconds")
+	cloudSDKEnv = flag.String("cloudsdk-env", "",
+		"comma-separated CLOUDSDK_*=value pairs (e.g. CLOUDSDK_CORE_PROJECT=my-project) to inject alongside credentials")
+	baseMountPath = flag.String("mount-path", secretMountPath,
+		"absolute directory under which service account secrets are mounted")
+	defaultMountSubdir = flag.String("default-mount-subdir", "",
+		"relative subdirectory of -mount-path under which service account secrets are mounted")
+	ksaMappingConfigMap = flag.String("ksa-mapping-configmap", "",
+		"namespace/name of a ConfigMap mapping Kubernetes ServiceAccount names (keys) to the secret to inject (values)")
+	namespaceDefaultSecret = flag.String("namespace-default-secret", "",
+		"comma-separated namespace=secret pairs naming the secret to inject into unannotated pods of a namespace")
+	expiryMonitorImage = flag.String("expiry-monitor-image", "",
+		"if set, add a sidecar running this image that exports the expiry of the mounted key as a metric, "+
+			"except to pods and Jobs that run to completion")
+	copyImage = flag.String("copy-image", "busybox",
+		"image of the init container copying the key to a writable volume for pods annotated "+writableAnnotation+"=true")
+	secretKey = flag.String("secret-key", serviceAccountFile,
+		"key of the secret holding the JSON credentials, also used as the mounted file name; overridable with "+secretKeyAnnotation)
+	removeEnv = flag.String("remove-env", "",
+		"comma-separated env var names to remove from target containers before injecting")
+	workers = flag.Int("workers", 2,
+		"number of pods initialized concurrently")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 20*time.Second,
+		"on SIGTERM, how long to wait for the pods and workloads already queued or being patched to be initialized before exiting")
+	patchRetries = flag.Int("patch-retries", 3,
+		"number of times a pod patch failing with a conflict or transient error is retried")
+	patchRetryDelay = flag.Duration("patch-retry-delay", 500*time.Millisecond,
+		"delay before the first patch retry, doubled for each further retry")
+	dryRun = flag.Bool("dry-run", false,
+		"log the patches that would inject objects instead of applying them")
+	dryRunInitialize = flag.Bool("dry-run-initialize", true,
+		"with -dry-run, still remove the initializer from objects so they are not left pending")
+	namespaceAllowlist = flag.String("namespace-allowlist", "",
+		"if set, comma-separated namespaces whose objects are injected; objects elsewhere are only initialized")
+	namespaceDenylist = flag.String("namespace-denylist", "",
+		"comma-separated namespaces whose objects are only initialized, never injected; wins over -namespace-allowlist")
+	secretFallback = flag.Bool("secret-fallback", false,
+		"inject the first existing secret among the pod annotation, ServiceAccount annotation, "+
+			"-ksa-mapping-configmap and namespace default, instead of the first one set")
+	requireSecretLabel = flag.String("require-secret-label", "",
+		"if set, a label selector (e.g. "+annotationPrefix+"mountable=true) the secret must match to be injected")
+)
+
+var (
+	// ksaMappingNamespace and ksaMappingName are parsed from
+	// -ksa-mapping-configmap.
+	ksaMappingNamespace, ksaMappingName string
+	// namespaceDefaultSecrets is parsed from -namespace-default-secret.
+	namespaceDefaultSecrets map[string]string
+	// cloudSDKEnvValues is parsed from -cloudsdk-env.
+	cloudSDKEnvValues map[string]string
+	// removeEnvNames is parsed from -remove-env.
+	removeEnvNames map[string]bool
+	// namespacePriorities is parsed from -namespace-priorities.
+	namespacePriorities map[string]int
+	// credentialsEnvNames is parsed from -credentials-env-name.
+	credentialsEnvNames = []string{credentialsEnv}
+	// allowedNamespaces and deniedNamespaces are parsed from
+	// -namespace-allowlist and -namespace-denylist; allowedNamespaces is nil
+	// when every namespace is allowed.
+	allowedNamespaces, deniedNamespaces map[string]bool
+	// requiredSecretSelector is parsed from -require-secret-label and is nil
+	// when the flag is unset.
+	requiredSecretSelector labels.Selector
+)
+
+// secretLookups caches the results of secretExists.
+var secretLookups = utilcache.NewLRUExpireCache(1024)
+
+// secretLookupSlots bounds the secretExists API requests in flight to
+// -max-concurrent-secret-lookups. It is set by validateFlags.
+var secretLookupSlots chan struct{}
+
+// tooManyInitializersWarned holds the UIDs of the objects already reported by
+// warnTooManyInitializers, which the informers see again on every update and
+// resync.
+var tooManyInitializersWarned = utilcache.NewLRUExpireCache(1024)
+
+// version is the initializer's build version, set with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// recorder records Events on the pods being initialized. It is nil until
+// main sets up the event broadcaster.
+var recorder record.EventRecorder
+
+var (
+	// serviceAccountLister is set when -watch-serviceaccounts,
+	// -skip-workload-identity or -credential-mode=workload-identity is
+	// enabled and is used to look up a pod's Kubernetes ServiceAccount.
+	serviceAccountLister corelisters.ServiceAccountLister
+	// nodeLister is set when -inject-topology-env is enabled.
+	nodeLister corelisters.NodeLister
+	// secretLister is set when -require-secret-label or -secret-fallback is
+	// enabled.
+	secretLister corelisters.SecretLister
+	// configMapLister is set when -ksa-mapping-configmap is enabled, and
+	// keeps the mapping up to date as the ConfigMap changes.
+	configMapLister corelisters.ConfigMapLister
 )
 
 type config struct {
@@ -52,19 +365,74 @@ type config struct {
 }
 
 func main() {
-	log.Println("Starting the GCP Service accounts initializer...")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s [flags] snippet SECRET-NAME\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := validateFlags(); err != nil {
+		log.Fatalf("invalid flags: %+v", err)
+	}
+	if *logFormat == logFormatJSON {
+		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(stdFormatter{})
+	}
 
-	log.Println("Using in-cluster token discovery")
-	clusterConfig, err := rest.InClusterConfig()
-	if err != nil {
-		log.Printf("failed to use in-cluster token: %+v", err)
-		kubecfg := filepath.Join(os.Getenv("HOME"), ".kube", "config")
-		log.Printf("Using kubeconfig file at %s", kubecfg)
-		clusterConfig, err = clientcmd.BuildConfigFromFlags("", kubecfg)
+	if flag.Arg(0) == "snippet" {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		out, err := generateSnippet(flag.Arg(1))
 		if err != nil {
-			log.Printf("failed to find kubeconfig file: %+v", err)
-			log.Fatal("No authentication is available.")
+			log.Fatalf("failed to generate snippet: %+v", err)
+		}
+		os.Stdout.Write(out)
+		return
+	}
+
+	log.Printf("Starting the GCP Service accounts initializer (version %s)...", version)
+
+	if *profilesFile != "" {
+		var err error
+		if profiles, err = loadProfiles(*profilesFile); err != nil {
+			log.Fatalf("failed to load -profiles-file: %+v", err)
+		}
+	}
+	if *transformPlugin != "" {
+		var err error
+		if transformPod, err = loadTransformPlugin(*transformPlugin); err != nil {
+			log.Fatalf("failed to load -transform-plugin: %+v", err)
+		}
+	}
+	if *csvLog != "" {
+		var err error
+		if decisions, err = openDecisionLog(*csvLog); err != nil {
+			log.Fatalf("failed to open -csv-log: %+v", err)
+		}
+	}
+	if *metricsAddr != "" {
+		var token string
+		if *metricsAuth == metricsAuthToken {
+			var err error
+			if token, err = loadMetricsToken(*metricsTokenFile); err != nil {
+				log.Fatalf("failed to load -metrics-token-file: %+v", err)
+			}
 		}
+		go serveMetrics(*metricsAddr, token)
+	}
+
+	clusterConfig, err := loadClusterConfig(*authMode, rest.InClusterConfig,
+		func() (*rest.Config, error) {
+			kubecfg := filepath.Join(os.Getenv("HOME"), ".kube", "config")
+			log.Printf("Using kubeconfig file at %s", kubecfg)
+			return clientcmd.BuildConfigFromFlags("", kubecfg)
+		})
+	if err != nil {
+		log.Printf("failed to load cluster config: %+v", err)
+		log.Fatal("No authentication is available.")
 	}
 
 	clientset, err := kubernetes.NewForConfig(clusterConfig)
@@ -72,14 +440,147 @@ func main() {
 		log.Fatalf("failed to initialize kubernetes client: %+v", err)
 	}
 
+	if *cleanupStale > 0 {
+		n, err := removeStaleInitializers(clientset, *cleanupStale, time.Now())
+		if err != nil {
+			log.Fatalf("cleanup failed: %+v", err)
+		}
+		log.Printf("Cleanup done, unblocked %d pods", n)
+		return
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{
+		Interface: clientset.CoreV1().Events(corev1.NamespaceAll)})
+	recorder = broadcaster.NewRecorder(scheme.Scheme,
+		corev1.EventSource{Component: componentName})
+
+	stop := make(chan struct{})
+
+	// Only the listers required by the enabled features are started.
+	factory := informers.NewSharedInformerFactory(clientset, resyncPeriod)
+	if *watchServiceAccounts || *skipWorkloadIdentity || *credentialMode == credentialModeWorkloadIdentity {
+		serviceAccountLister = factory.Core().V1().ServiceAccounts().Lister()
+	}
+	if *injectTopologyEnv {
+		nodeLister = factory.Core().V1().Nodes().Lister()
+	}
+	if requiredSecretSelector != nil || *secretFallback {
+		secretLister = factory.Core().V1().Secrets().Lister()
+	}
+	if *ksaMappingConfigMap != "" {
+		configMapLister = factory.Core().V1().ConfigMaps().Lister()
+	}
+	factory.Start(stop)
+	for typ, ok := range factory.WaitForCacheSync(stop) {
+		if !ok {
+			log.Fatalf("failed to sync informer cache for %v", typ)
+		}
+	}
+
 	// Watch uninitialized Pods in all namespaces.
-	restClient := clientset.CoreV1().RESTClient()
-	watchlist := cache.NewListWatchFromClient(restClient,
-		"pods", corev1.NamespaceAll, fields.Everything())
+	includeUninitializedWatchlist := uninitializedListWatch(
+		clientset.CoreV1().RESTClient(), "pods")
+
+	// The informer only queues pending pods; workers initialize them. Updates
+	// are queued too, so a pod annotated while still pending is injected.
+	var queue *initQueue
+	store, controller := cache.NewInformer(includeUninitializedWatchlist,
+		&corev1.Pod{},
+		resyncPeriod,
+		pendingOnly(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { queue.enqueue(obj) },
+			UpdateFunc: func(_, obj interface{}) { queue.enqueue(obj) },
+		}),
+	)
+	var podQueue workqueue.RateLimitingInterface
+	if len(namespacePriorities) > 0 {
+		podQueue = newPriorityQueue(workqueue.DefaultControllerRateLimiter(), podKeyPriority)
+	} else {
+		podQueue = workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "pods")
+	}
+	queue = newPodQueue(podQueue, store, clientset)
+
+	// Pods pending initialization when the initializer starts are listed all
+	// at once; optionally pace them so the patches don't burst the API server.
+	if *initialSyncQPS > 0 {
+		queue.limiter = flowcontrol.NewTokenBucketRateLimiter(float32(*initialSyncQPS), 1)
+		queue.synced = controller.HasSynced
+	}
+
+	go controller.Run(stop)
+	queue.start(*workers)
+	informed := []string{"pods"}
+
+	// Workloads are initialized through their pod templates, from queues of
+	// their own.
+	var workloadQueues []*initQueue
+	workloads := []struct {
+		client   cache.Getter
+		resource string
+		objType  runtime.Object
+	}{
+		{clientset.AppsV1beta1().RESTClient(), "statefulsets", &appsv1beta1.StatefulSet{}},
+		{clientset.ExtensionsV1beta1().RESTClient(), "daemonsets", &extensionsv1beta1.DaemonSet{}},
+		{clientset.BatchV1().RESTClient(), "jobs", &batchv1.Job{}},
+		{clientset.BatchV1beta1().RESTClient(), "cronjobs", &batchv1beta1.CronJob{}},
+	}
+	for _, w := range workloads {
+		var workloadQueue *initQueue
+		workloadStore, workloadController := cache.NewInformer(
+			uninitializedListWatch(w.client, w.resource),
+			w.objType,
+			resyncPeriod,
+			pendingOnly(cache.ResourceEventHandlerFuncs{
+				AddFunc:    func(obj interface{}) { workloadQueue.enqueue(obj) },
+				UpdateFunc: func(_, obj interface{}) { workloadQueue.enqueue(obj) },
+			}),
+		)
+		workloadQueue = newWorkloadQueue(
+			workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), w.resource),
+			workloadStore, clientset)
+		go workloadController.Run(stop)
+		workloadQueue.start(*workers)
+		workloadQueues = append(workloadQueues, workloadQueue)
+		informed = append(informed, w.resource)
+	}
+
+	if *healthAddr != "" {
+		go serveHealth(*healthAddr, controller.HasSynced, resolvedInfo(informed))
+	}
+
+	// Pods cannot be re-injected once initialized, so only workloads are
+	// reconciled.
+	if *reconcileInterval > 0 {
+		for _, q := range workloadQueues {
+			go wait.Until(q.reconcile, *reconcileInterval, stop)
+		}
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	<-signalChan
+
+	log.Println("Shutdown signal received, draining objects being initialized...")
+	close(stop)
+	drained, finished := shutdownQueues(append(workloadQueues, queue), *shutdownTimeout)
+	if !finished {
+		log.Printf("-shutdown-timeout %v reached after draining %d objects, exiting with objects still being initialized",
+			*shutdownTimeout, drained)
+		return
+	}
+	log.Printf("Drained %d objects, exiting...", drained)
+}
+
+// uninitializedListWatch watches resource in all namespaces, including
+// objects that are still pending initialization.
+func uninitializedListWatch(c cache.Getter, resource string) *cache.ListWatch {
+	watchlist := cache.NewListWatchFromClient(c,
+		resource, corev1.NamespaceAll, fields.Everything())
 
 	// Wrap the returned watchlist to workaround the inability to include
 	// the `IncludeUninitialized` list option when setting up watch clients.
-	includeUninitializedWatchlist := &cache.ListWatch{
+	return &cache.ListWatch{
 		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
 			options.IncludeUninitialized = true
 			return watchlist.List(options)
@@ -89,135 +590,1844 @@ func main() {
 			return watchlist.Watch(options)
 		},
 	}
+}
 
-	_, controller := cache.NewInformer(includeUninitializedWatchlist,
-		&corev1.Pod{},
-		resyncPeriod,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				pod, ok := obj.(*corev1.Pod)
-				if !ok {
-					log.Fatalf("watch returned non-pod object: %T", obj)
-				}
+// pendingOnly wraps handler so that it only receives objects pending this
+// initializer; everything else the informers see is dropped up front. An
+// update removing this initializer, e.g. our own patch, reaches handler as a
+// delete, so it is never initialized twice.
+func pendingOnly(handler cache.ResourceEventHandler) cache.ResourceEventHandler {
+	return cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			o, ok := obj.(metav1.Object)
+			if !ok {
+				return false
+			}
+			if needsInitialization(o) {
+				return true
+			}
+			// Only objects pending this initializer next are skipped
+			// because of the limit; the others are simply not ours yet.
+			if pendingNext(o) && tooManyInitializers(o) {
+				warnTooManyInitializers(o)
+			}
+			return false
+		},
+		Handler: handler,
+	}
+}
 
-				if !needsInitialization(pod) {
-					log.Printf("skipping pod/%s", pod.GetName())
-					return
-				}
+// validateFlags checks that the command-line flags hold supported values.
+func validateFlags() error {
+	switch *envInjectOrder {
+	case envInjectAppend, envInjectPrepend:
+	default:
+		return fmt.Errorf("-env-inject-order must be %q or %q, got %q",
+			envInjectAppend, envInjectPrepend, *envInjectOrder)
+	}
 
-				modifiedPod := pod.DeepCopy()
-				if !modifyPodSpec(modifiedPod) {
-					log.Printf("no injection in pod/%s", pod.GetName())
-				}
+	switch *existingCredentialsEnv {
+	case existingEnvSkip, existingEnvOverwrite, existingEnvMount:
+	default:
+		return fmt.Errorf("-existing-credentials-env must be %q, %q or %q, got %q",
+			existingEnvSkip, existingEnvOverwrite, existingEnvMount, *existingCredentialsEnv)
+	}
 
-				removeSelfPendingInitializer(modifiedPod)
+	switch *credentialMode {
+	case credentialModeSecret, credentialModeWorkloadIdentity:
+	default:
+		return fmt.Errorf("-credential-mode must be %q or %q, got %q",
+			credentialModeSecret, credentialModeWorkloadIdentity, *credentialMode)
+	}
 
-				if err := patchPod(pod, modifiedPod, clientset); err != nil {
-					log.Printf("error saving pod/%s: %+v", pod.GetName(), err)
-				} else {
-					log.Printf("initialized pod/%s", pod.GetName())
-				}
-			},
-		},
-	)
+	switch *logFormat {
+	case logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("-log-format must be %q or %q, got %q",
+			logFormatText, logFormatJSON, *logFormat)
+	}
 
-	stop := make(chan struct{})
-	go controller.Run(stop)
+	switch *metricsAuth {
+	case metricsAuthNone:
+	case metricsAuthToken:
+		if *metricsTokenFile == "" {
+			return fmt.Errorf("-metrics-auth=%s requires -metrics-token-file", metricsAuthToken)
+		}
+	default:
+		return fmt.Errorf("-metrics-auth must be %q or %q, got %q",
+			metricsAuthNone, metricsAuthToken, *metricsAuth)
+	}
 
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
-	<-signalChan
+	switch *authMode {
+	case authModeAuto, authModeInCluster, authModeKubeconfig:
+	default:
+		return fmt.Errorf("-auth-mode must be %q, %q or %q, got %q",
+			authModeAuto, authModeInCluster, authModeKubeconfig, *authMode)
+	}
 
-	log.Println("Shutdown signal received, exiting...")
-	close(stop)
+	if !path.IsAbs(*baseMountPath) || path.Clean(*baseMountPath) == "/" {
+		return fmt.Errorf("-mount-path must be an absolute path below /, got %q", *baseMountPath)
+	}
+	if *defaultMountSubdir != "" && (path.IsAbs(*defaultMountSubdir) ||
+		!withinRoot(*baseMountPath, path.Join(*baseMountPath, *defaultMountSubdir))) {
+		return fmt.Errorf("-default-mount-subdir must be a relative path below %s, got %q",
+			*baseMountPath, *defaultMountSubdir)
+	}
+
+	if *disableEnvInjection && *inlineCredentials {
+		return fmt.Errorf("-disable-env-injection and -inline-credentials are mutually exclusive")
+	}
+	if *transformPlugin != "" && !pluginsSupported {
+		return fmt.Errorf("-transform-plugin requires a binary built with cgo for Linux or macOS; " +
+			"the official image is built without cgo")
+	}
+	if *workers < 1 {
+		return fmt.Errorf("-workers must be at least 1, got %d", *workers)
+	}
+	if *shutdownTimeout < 0 {
+		return fmt.Errorf("-shutdown-timeout must not be negative, got %v", *shutdownTimeout)
+	}
+	if *patchRetries < 0 {
+		return fmt.Errorf("-patch-retries must not be negative, got %d", *patchRetries)
+	}
+	if *maxPendingInitializers < 0 {
+		return fmt.Errorf("-max-pending-initializers must not be negative, got %d", *maxPendingInitializers)
+	}
+	if *maxSecretLookups < 1 {
+		return fmt.Errorf("-max-concurrent-secret-lookups must be at least 1, got %d", *maxSecretLookups)
+	}
+	if *maxInjectedVolumes < 0 {
+		return fmt.Errorf("-max-injected-volumes must not be negative, got %d", *maxInjectedVolumes)
+	}
+	if *dumpMaxFiles < 2 {
+		return fmt.Errorf("-dump-max-files must be at least 2, got %d", *dumpMaxFiles)
+	}
+
+	if *totalShards < 1 || *shard < 0 || *shard >= *totalShards {
+		return fmt.Errorf("-shard must be in [0, -total-shards), got %d of %d", *shard, *totalShards)
+	}
+
+	var err error
+	if *ksaMappingConfigMap != "" {
+		ksaMappingNamespace, ksaMappingName, err = cache.SplitMetaNamespaceKey(*ksaMappingConfigMap)
+		if err != nil || ksaMappingNamespace == "" {
+			return fmt.Errorf("-ksa-mapping-configmap must be namespace/name, got %q", *ksaMappingConfigMap)
+		}
+	}
+	if namespaceDefaultSecrets, err = parseKeyValues(*namespaceDefaultSecret); err != nil {
+		return fmt.Errorf("-namespace-default-secret: %+v", err)
+	}
+	priorities, err := parseKeyValues(*namespacePriority)
+	if err != nil {
+		return fmt.Errorf("-namespace-priorities: %+v", err)
+	}
+	namespacePriorities = make(map[string]int)
+	for namespace, v := range priorities {
+		if namespacePriorities[namespace], err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("-namespace-priorities: priority of %s must be an integer, got %q", namespace, v)
+		}
+	}
+	if cloudSDKEnvValues, err = parseKeyValues(*cloudSDKEnv); err != nil {
+		return fmt.Errorf("-cloudsdk-env: %+v", err)
+	}
+	for name := range cloudSDKEnvValues {
+		if !strings.HasPrefix(name, cloudSDKEnvPrefix) {
+			return fmt.Errorf("-cloudsdk-env: %q does not start with %s", name, cloudSDKEnvPrefix)
+		}
+		if errs := validation.IsEnvVarName(name); len(errs) > 0 {
+			return fmt.Errorf("-cloudsdk-env: %q: %s", name, strings.Join(errs, "; "))
+		}
+	}
+	if errs := validation.IsConfigMapKey(*secretKey); len(errs) > 0 {
+		return fmt.Errorf("-secret-key: %q: %s", *secretKey, strings.Join(errs, "; "))
+	}
+
+	credentialsEnvNames = nil
+	for _, name := range strings.Split(*credentialsEnvName, ",") {
+		if errs := validation.IsEnvVarName(name); len(errs) > 0 {
+			return fmt.Errorf("-credentials-env-name: %q: %s", name, strings.Join(errs, "; "))
+		}
+		credentialsEnvNames = append(credentialsEnvNames, name)
+	}
+
+	removeEnvNames = make(map[string]bool)
+	if *removeEnv != "" {
+		for _, name := range strings.Split(*removeEnv, ",") {
+			if errs := validation.IsEnvVarName(name); len(errs) > 0 {
+				return fmt.Errorf("-remove-env: %q: %s", name, strings.Join(errs, "; "))
+			}
+			removeEnvNames[name] = true
+		}
+	}
+	if allowedNamespaces, err = parseNamespaces(*namespaceAllowlist); err != nil {
+		return fmt.Errorf("-namespace-allowlist: %+v", err)
+	}
+	if deniedNamespaces, err = parseNamespaces(*namespaceDenylist); err != nil {
+		return fmt.Errorf("-namespace-denylist: %+v", err)
+	}
+	secretLookupSlots = make(chan struct{}, *maxSecretLookups)
+	requiredSecretSelector = nil
+	if *requireSecretLabel != "" {
+		if requiredSecretSelector, err = labels.Parse(*requireSecretLabel); err != nil {
+			return fmt.Errorf("-require-secret-label: %+v", err)
+		}
+	}
+	return nil
+}
+
+// parseNamespaces parses a comma-separated list of namespaces into a set,
+// which is nil if s is empty.
+func parseNamespaces(s string) (map[string]bool, error) {
+	if s == "" {
+		return nil, nil
+	}
+	m := make(map[string]bool)
+	for _, ns := range strings.Split(s, ",") {
+		if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid namespace %q: %s", ns, strings.Join(errs, "; "))
+		}
+		m[ns] = true
+	}
+	return m, nil
+}
+
+// namespaceSelected reports whether objects in the namespace may be injected
+// per -namespace-allowlist and -namespace-denylist. Objects in other
+// namespaces still have the initializer removed so they are not blocked.
+func namespaceSelected(namespace string) bool {
+	if deniedNamespaces[namespace] {
+		return false
+	}
+	return allowedNamespaces == nil || allowedNamespaces[namespace]
+}
+
+// parseKeyValues parses a comma-separated list of key=value pairs.
+func parseKeyValues(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	if s == "" {
+		return m, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("malformed pair %q, expected key=value", kv)
+		}
+		if _, dup := m[parts[0]]; dup {
+			return nil, fmt.Errorf("duplicate key %q", parts[0])
+		}
+		m[parts[0]] = parts[1]
+	}
+	return m, nil
+}
+
+// loadClusterConfig returns the API server config for the given -auth-mode.
+// In auto mode the kubeconfig loader is only tried if in-cluster discovery
+// fails.
+func loadClusterConfig(mode string, inCluster, kubeconfig func() (*rest.Config, error)) (*rest.Config, error) {
+	switch mode {
+	case authModeInCluster:
+		log.Println("Using in-cluster token discovery")
+		return inCluster()
+	case authModeKubeconfig:
+		return kubeconfig()
+	case authModeAuto:
+		log.Println("Using in-cluster token discovery")
+		cfg, err := inCluster()
+		if err == nil {
+			return cfg, nil
+		}
+		log.Printf("failed to use in-cluster token: %+v", err)
+		return kubeconfig()
+	}
+	return nil, fmt.Errorf("unknown auth mode %q", mode)
+}
+
+// initializePod injects the service account into a pod pending this
+// initializer and removes the initializer from its pending list. It returns
+// an error if the pod is left pending and should be retried.
+func initializePod(pod *corev1.Pod, clientset kubernetes.Interface) error {
+	if shardFor(pod.GetUID(), *totalShards) != *shard {
+		return nil
+	}
+	if !needsInitialization(pod) {
+		podLogger(pod, "skip").Printf("skipping pod/%s", pod.GetName())
+		return nil
+	}
+	podsProcessed.Inc()
+
+	modifiedPod := pod.DeepCopy()
+	var names []string
+	if namespaceSelected(pod.GetNamespace()) {
+		names = mutatePod(modifiedPod)
+	}
+	injected := len(names) > 0
+	var sa string
+	if injected {
+		sa = names[0]
+		// With Workload Identity, no secret is mounted.
+		if *credentialMode == credentialModeWorkloadIdentity {
+			names = nil
+		}
+		for _, name := range names {
+			if secretExists(clientset, pod.GetNamespace(), name) {
+				continue
+			}
+			msg := fmt.Sprintf("secret %q not found in namespace %s, the pod will not start until it is created",
+				name, pod.GetNamespace())
+			if recorder != nil {
+				recorder.Event(pod, corev1.EventTypeWarning, "SecretNotFound", msg)
+			}
+			if *requireSecret {
+				podLogger(pod, "require-secret").Printf("not initializing pod/%s: %s", pod.GetName(), msg)
+				recordDecision(pod, "pod/"+pod.GetName(), name, decisionSecretMissing)
+				decisionsTotal.WithLabelValues(reasonSecretMissing).Inc()
+				return fmt.Errorf("secret/%s not found", name)
+			}
+			podLogger(pod, "require-secret").Printf("warning: pod/%s: %s", pod.GetName(), msg)
+		}
+	}
+	if !injected {
+		podLogger(pod, "skip-injection").Printf("no injection in pod/%s", pod.GetName())
+	} else if *dumpDir != "" {
+		if err := dumpPod(*dumpDir, pod, modifiedPod, time.Now(), *dumpMaxFiles); err != nil {
+			podLogger(pod, "dump").Printf("failed to dump pod/%s: %+v", pod.GetName(), err)
+		}
+	}
+
+	removeSelfPendingInitializer(modifiedPod)
+
+	err := patchPodWithRetry(pod, modifiedPod, clientset, func(latest *corev1.Pod) *corev1.Pod {
+		rebuilt := latest.DeepCopy()
+		if injected {
+			mutatePod(rebuilt)
+		}
+		removeSelfPendingInitializer(rebuilt)
+		return rebuilt
+	})
+	if err == nil && *dryRun {
+		podLogger(pod, "dry-run").Printf("dry run done for pod/%s", pod.GetName())
+		recordDecision(pod, "pod/"+pod.GetName(), sa, decisionDryRun)
+		decisionsTotal.WithLabelValues(reasonDryRun).Inc()
+		return nil
+	}
+	if err == nil {
+		logger := podLogger(pod, "initialize")
+		if injected {
+			logger = logger.WithField("serviceAccount", sa)
+		}
+		logger.Printf("initialized pod/%s", pod.GetName())
+		if injected {
+			injections.Inc()
+			recordDecision(pod, "pod/"+pod.GetName(), sa, decisionInjected)
+			decisionsTotal.WithLabelValues(reasonInjected).Inc()
+			if recorder != nil {
+				recorder.Eventf(pod, corev1.EventTypeNormal, "CredentialsInjected",
+					"Injected credentials of service account %s", sa)
+			}
+			recordInjectionCondition(pod, corev1.ConditionTrue, "CredentialsInjected",
+				"GCP service account credentials were injected", clientset)
+		} else {
+			recordDecision(pod, "pod/"+pod.GetName(), "", decisionSkipped)
+			decisionsTotal.WithLabelValues(skipReason(pod)).Inc()
+			recordInjectionCondition(pod, corev1.ConditionFalse, "NotRequested",
+				"no GCP service account was requested for this pod", clientset)
+		}
+		return nil
+	}
+	podLogger(pod, "patch").Printf("error saving pod/%s: %+v", pod.GetName(), err)
+	if recorder != nil {
+		recorder.Eventf(pod, corev1.EventTypeWarning, "InjectionFailed",
+			"Failed to initialize pod: %s", apierrors.ReasonForError(err))
+	}
+	recordDecision(pod, "pod/"+pod.GetName(), sa, decisionFailed)
+	decisionsTotal.WithLabelValues(reasonPatchFailed).Inc()
+
+	if !*failOpen || !isPatchRejection(err) {
+		return err
+	}
+	podLogger(pod, "fail-open").Printf("patch for pod/%s rejected (reason: %s), retrying without injection",
+		pod.GetName(), apierrors.ReasonForError(err))
+	minimalPod := pod.DeepCopy()
+	removeSelfPendingInitializer(minimalPod)
+	if err := patchPod(pod, minimalPod, clientset); err != nil {
+		podLogger(pod, "fail-open").Printf("error saving pod/%s without injection: %+v", pod.GetName(), err)
+		return err
+	}
+	podLogger(pod, "fail-open").Printf("initialized pod/%s in degraded mode: credentials were not injected", pod.GetName())
+	recordDecision(pod, "pod/"+pod.GetName(), sa, decisionFailOpen)
+	decisionsTotal.WithLabelValues(reasonFailOpen).Inc()
+	recordInjectionCondition(pod, corev1.ConditionFalse, "PatchRejected",
+		fmt.Sprintf("injection patch was rejected: %s", apierrors.ReasonForError(err)), clientset)
+	return nil
+}
+
+// podLogger returns a logger carrying the pod and the action being logged as
+// fields, which are only visible with -log-format=json.
+func podLogger(pod *corev1.Pod, action string) *log.Entry {
+	return log.WithFields(log.Fields{
+		"pod":       pod.GetName(),
+		"namespace": pod.GetNamespace(),
+		"action":    action})
+}
+
+// stdFormatter formats log entries like the standard library logger, so the
+// default text output is unchanged from before structured logging.
+type stdFormatter struct{}
+
+func (stdFormatter) Format(e *log.Entry) ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteString(e.Time.Format("2006/01/02 15:04:05 "))
+	b.WriteString(e.Message)
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// recordInjectionCondition sets the InjectionApplied condition on the pod's
+// status when -status-condition is enabled. Failures are only logged since
+// the pod itself has already been initialized.
+func recordInjectionCondition(pod *corev1.Pod, status corev1.ConditionStatus, reason, message string, clientset kubernetes.Interface) {
+	if !*statusCondition {
+		return
+	}
+	newPod := pod.DeepCopy()
+	setPodCondition(&newPod.Status, corev1.PodCondition{
+		Type:               injectionConditionType,
+		Status:             status,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            message,
+	})
+
+	patch, err := createPodPatch(pod, newPod)
+	if err != nil {
+		log.Printf("failed to create status patch for pod/%s: %+v", pod.GetName(), err)
+		return
+	}
+	if _, err := clientset.CoreV1().Pods(pod.GetNamespace()).Patch(
+		pod.GetName(), types.StrategicMergePatchType, patch, "status"); err != nil {
+		log.Printf("failed to set %s condition on pod/%s: %+v",
+			injectionConditionType, pod.GetName(), err)
+	}
+}
+
+// setPodCondition adds the condition to status, replacing any existing
+// condition of the same type.
+func setPodCondition(status *corev1.PodStatus, cond corev1.PodCondition) {
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == cond.Type {
+			status.Conditions[i] = cond
+			return
+		}
+	}
+	status.Conditions = append(status.Conditions, cond)
+}
+
+// isPatchRejection reports whether err means the API server (or an admission
+// webhook) refused the patch's content, as opposed to a transient failure.
+func isPatchRejection(err error) bool {
+	return apierrors.IsInvalid(err) || apierrors.IsForbidden(err) || apierrors.IsBadRequest(err)
+}
+
+// removeStaleInitializers removes this initializer, without injecting
+// anything, from every pod that has been pending it for longer than
+// olderThan. It is meant to unblock pods left behind after the
+// InitializerConfiguration is deleted, or skipped because of
+// -max-pending-initializers. Returns the number of pods unblocked.
+func removeStaleInitializers(clientset kubernetes.Interface, olderThan time.Duration, now time.Time) (int, error) {
+	pods, err := clientset.CoreV1().Pods(corev1.NamespaceAll).List(
+		metav1.ListOptions{IncludeUninitialized: true})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list pods: %+v", err)
+	}
+
+	var n int
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !pendingNext(pod) || now.Sub(pod.GetCreationTimestamp().Time) < olderThan {
+			continue
+		}
+		unblockedPod := pod.DeepCopy()
+		removeSelfPendingInitializer(unblockedPod)
+		if err := patchPod(pod, unblockedPod, clientset); err != nil {
+			log.Printf("error unblocking pod/%s: %+v", pod.GetName(), err)
+			continue
+		}
+		log.Printf("unblocked stale pod/%s", pod.GetName())
+		n++
+	}
+	return n, nil
+}
+
+// shardFor maps an object UID onto one of total shards.
+func shardFor(uid types.UID, total int) int {
+	h := fnv.New32a()
+	h.Write([]byte(uid))
+	return int(h.Sum32() % uint32(total))
+}
+
+// needsInitialization determines if the object is required to be
+// initialized currently by this initializer. Objects with an unusually long
+// pending list, per -max-pending-initializers, are never initialized.
+func needsInitialization(obj metav1.Object) bool {
+	return pendingNext(obj) && !tooManyInitializers(obj)
 }
 
-// needsInitialization determines if the pod is required to be initialized
-// currently by this initializer.
-func needsInitialization(pod *corev1.Pod) bool {
-	initializers := pod.ObjectMeta.GetInitializers()
-	return initializers != nil &&
-		len(initializers.Pending) > 0 &&
+// pendingNext reports whether this initializer is the next one pending on
+// obj, regardless of -max-pending-initializers.
+func pendingNext(obj metav1.Object) bool {
+	initializers := obj.GetInitializers()
+	return initializers != nil && len(initializers.Pending) > 0 &&
 		initializers.Pending[0].Name == initializerName
 }
 
+// tooManyInitializers reports whether obj has more pending initializers than
+// -max-pending-initializers allows.
+func tooManyInitializers(obj metav1.Object) bool {
+	initializers := obj.GetInitializers()
+	return *maxPendingInitializers > 0 && initializers != nil &&
+		len(initializers.Pending) > *maxPendingInitializers
+}
+
+// warnTooManyInitializers logs, once per object, that obj is left pending
+// because of -max-pending-initializers. Such objects can only be unblocked
+// by hand or with -cleanup-stale.
+func warnTooManyInitializers(obj metav1.Object) {
+	if _, warned := tooManyInitializersWarned.Get(obj.GetUID()); warned {
+		return
+	}
+	tooManyInitializersWarned.Add(obj.GetUID(), true, 24*time.Hour)
+	log.Printf("warning: skipping %s: %d pending initializers exceed -max-pending-initializers=%d, "+
+		"it stays pending until unblocked with -cleanup-stale",
+		obj.GetName(), len(obj.GetInitializers().Pending), *maxPendingInitializers)
+}
+
 // removeSelfPendingInitializer removes the first element from pending
-// initializers list of in-memory pod value.
-func removeSelfPendingInitializer(pod *corev1.Pod) {
-	if pod.ObjectMeta.GetInitializers() == nil {
+// initializers list of in-memory object value.
+func removeSelfPendingInitializer(obj metav1.Object) {
+	initializers := obj.GetInitializers()
+	if initializers == nil {
 		return
 	}
-	pendingInitializers := pod.ObjectMeta.GetInitializers().Pending
+	pendingInitializers := initializers.Pending
 	if len(pendingInitializers) == 1 {
-		pod.ObjectMeta.Initializers.Pending = nil
+		initializers.Pending = nil
 	} else if len(pendingInitializers) > 1 {
-		pod.ObjectMeta.Initializers.Pending = append(
+		initializers.Pending = append(
 			pendingInitializers[:0], pendingInitializers[1:]...)
 	}
 }
 
 // patchPod saves the pod to the API using a strategic 2-way JSON merge patch.
-func patchPod(origPod, newPod *corev1.Pod, clientset *kubernetes.Clientset) error {
-	origData, err := json.Marshal(origPod)
+func patchPod(origPod, newPod *corev1.Pod, clientset kubernetes.Interface) error {
+	patch, err := createPodPatch(origPod, newPod)
 	if err != nil {
-		return fmt.Errorf("failed to marshal original pod: %+v", err)
+		return err
 	}
-
-	newData, err := json.Marshal(newPod)
-	if err != nil {
-		return fmt.Errorf("failed to marshal modified pod: %+v", err)
+	if *dryRun {
+		logDryRun(podLogger(origPod, "dry-run"), "pod/"+origPod.GetName(), patch)
+		if !*dryRunInitialize {
+			return nil
+		}
+		minimalPod := origPod.DeepCopy()
+		removeSelfPendingInitializer(minimalPod)
+		if patch, err = createPodPatch(origPod, minimalPod); err != nil {
+			return err
+		}
 	}
 
-	patch, err := strategicpatch.CreateTwoWayMergePatch(origData, newData, corev1.Pod{})
+	// The API error is returned as-is so callers can inspect its status.
+	start := time.Now()
+	_, err = clientset.CoreV1().Pods(origPod.GetNamespace()).Patch(
+		origPod.GetName(), types.StrategicMergePatchType, patch)
+	patchDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
-		return fmt.Errorf("failed to create 2-way merge patch: %+v", err)
+		patchErrors.Inc()
+		return err
 	}
 
-	if _, err = clientset.CoreV1().Pods(origPod.GetNamespace()).Patch(
-		origPod.GetName(), types.StrategicMergePatchType, patch); err != nil {
-		return fmt.Errorf("failed to patch pod/%s: %+v", origPod.GetName(), err)
+	if *patchEvents && recorder != nil {
+		recorder.Eventf(origPod, corev1.EventTypeNormal, "Patched",
+			"Applied patch: %s", truncate(string(patch), maxEventPatchLength))
 	}
 	return nil
 }
 
-// modifyPodSpec makes modifications to in-memory pod value to inject the
-// service account. Returns whether any modifications have been made.
-func modifyPodSpec(pod *corev1.Pod) bool {
-	if pod == nil || pod.ObjectMeta.Annotations == nil {
-		return false
+// patchPodWithRetry saves the pod like patchPod, retrying conflicts and
+// transient errors up to -patch-retries times with exponential backoff. On a
+// conflict the pod is fetched again and rebuild recomputes the modified pod
+// from the latest version.
+func patchPodWithRetry(origPod, newPod *corev1.Pod, clientset kubernetes.Interface,
+	rebuild func(latest *corev1.Pod) *corev1.Pod) error {
+	backoff := wait.Backoff{Duration: *patchRetryDelay, Factor: 2, Jitter: 0.1, Steps: *patchRetries + 1}
+	var err error
+	waitErr := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		err = patchPod(origPod, newPod, clientset)
+		switch {
+		case err == nil:
+			return true, nil
+		case apierrors.IsConflict(err):
+			latest, getErr := clientset.CoreV1().Pods(origPod.GetNamespace()).Get(
+				origPod.GetName(), metav1.GetOptions{IncludeUninitialized: true})
+			if getErr != nil {
+				podLogger(origPod, "patch").Printf("failed to get pod/%s after conflict: %+v", origPod.GetName(), getErr)
+				return false, nil
+			}
+			if !needsInitialization(latest) {
+				return false, err
+			}
+			origPod, newPod = latest, rebuild(latest)
+		case !isTransient(err):
+			return false, err
+		}
+		podLogger(origPod, "patch").Printf("retrying patch of pod/%s: %+v", origPod.GetName(), err)
+		return false, nil
+	})
+	if waitErr == wait.ErrWaitTimeout {
+		return err
 	}
-	serviceAccountName, ok := pod.ObjectMeta.Annotations[annotation]
-	if !ok {
-		return false
+	return waitErr
+}
+
+// isTransient reports whether err, returned by the API, may go away if the
+// request is retried. Errors not coming from the API server, e.g. connection
+// failures, are considered transient.
+func isTransient(err error) bool {
+	if _, ok := err.(apierrors.APIStatus); !ok {
+		return true
 	}
+	return apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) || apierrors.IsInternalError(err) ||
+		apierrors.IsUnexpectedServerError(err)
+}
 
-	volName := fmt.Sprintf("gcp-%s", serviceAccountName)
-	mountPath := path.Join(secretMountPath, serviceAccountName)
-	keyPath := path.Join(mountPath, serviceAccountFile)
+// logDryRun logs the patch that -dry-run keeps from being applied to object,
+// pretty-printed.
+func logDryRun(logger *log.Entry, object string, patch []byte) {
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, patch, "", "  "); err != nil {
+		pretty.Reset()
+		pretty.Write(patch)
+	}
+	logger.Printf("dry run, not applying patch to %s:\n%s", object, pretty.String())
+}
 
-	pod.Spec.Volumes = append(pod.Spec.Volumes,
-		corev1.Volume{
-			Name: volName,
-			VolumeSource: corev1.VolumeSource{
-				Secret: &corev1.SecretVolumeSource{
-					SecretName: serviceAccountName,
-					Items: []corev1.KeyToPath{{
-						Key:  "key.json",
-						Path: "key.json",
-					}}}}})
+// createPodPatch computes the strategic 2-way JSON merge patch from origPod to
+// newPod. The patch only contains the fields that differ, so e.g. an
+// annotation-only change yields a patch touching just that annotation.
+func createPodPatch(origPod, newPod *corev1.Pod) ([]byte, error) {
+	return createPatch(origPod, newPod, corev1.Pod{})
+}
 
-	for i, c := range pod.Spec.Containers {
-		pod.Spec.Containers[i].VolumeMounts = append(pod.Spec.Containers[i].VolumeMounts,
-			corev1.VolumeMount{
-				Name:      volName,
-				MountPath: mountPath,
-				SubPath:   "",
-				ReadOnly:  true})
+// createPatch computes the strategic 2-way JSON merge patch from orig to
+// new, using dataStruct for the patch strategy of their type.
+func createPatch(orig, new, dataStruct interface{}) ([]byte, error) {
+	origData, err := json.Marshal(orig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal original object: %+v", err)
+	}
 
-		pod.Spec.Containers[i].Env = append(c.Env, corev1.EnvVar{
-			Name:  "GOOGLE_APPLICATION_CREDENTIALS",
-			Value: keyPath})
+	newData, err := json.Marshal(new)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal modified object: %+v", err)
 	}
 
+	patch, err := strategicpatch.CreateTwoWayMergePatch(origData, newData, dataStruct)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create 2-way merge patch: %+v", err)
+	}
+	return patch, nil
+}
+
+// truncate shortens s to at most n bytes, marking it as truncated.
+func truncate(s string, n int) string {
+	const marker = "...(truncated)"
+	if len(s) <= n {
+		return s
+	}
+	if n <= len(marker) {
+		return s[:n]
+	}
+	return s[:n-len(marker)] + marker
+}
+
+// modifyPodSpec makes modifications to in-memory pod value to inject the
+// service account. Returns the names of the service accounts actually
+// injected, first the one the credentials env var points to, or nil if no
+// modifications have been made.
+func modifyPodSpec(pod *corev1.Pod) []string {
+	if pod == nil {
+		return nil
+	}
+	if unknown := unknownAnnotations(pod.ObjectMeta.Annotations); len(unknown) > 0 {
+		log.Printf("warning: pod/%s has unrecognized annotations: %s",
+			pod.GetName(), strings.Join(unknown, ", "))
+		if *strictAnnotations {
+			return nil
+		}
+	}
+	if err := validateAnnotationLengths(pod.ObjectMeta.Annotations); err != nil {
+		log.Printf("rejecting annotations on pod/%s: %+v", pod.GetName(), err)
+		return nil
+	}
+	if !injectionEnabled(pod) {
+		return nil
+	}
+	if usesWorkloadIdentity(pod) {
+		log.Printf("skipping pod/%s, its serviceaccount/%s uses Workload Identity",
+			pod.GetName(), ksaNameFor(pod))
+		return nil
+	}
+	serviceAccountNames, ok := gcpServiceAccountsFor(pod)
+	if !ok {
+		return nil
+	}
+	for _, name := range serviceAccountNames {
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			log.Printf("rejecting invalid secret name %q for pod/%s: %s",
+				truncate(name, *maxAnnotationLength), pod.GetName(), strings.Join(errs, "; "))
+			return nil
+		}
+		if !secretMountable(pod.GetNamespace(), name) {
+			log.Printf("secret/%s for pod/%s does not match -require-secret-label %q",
+				name, pod.GetName(), *requireSecretLabel)
+			return nil
+		}
+	}
+	serviceAccountName := serviceAccountNames[0]
+
+	mountPath, err := mountPathFor(serviceAccountName)
+	if err != nil {
+		log.Printf("rejecting annotation on pod/%s: %+v", pod.GetName(), err)
+		return nil
+	}
+	key, err := secretKeyFor(pod, serviceAccountName)
+	if err != nil {
+		log.Printf("rejecting annotation on pod/%s: %+v", pod.GetName(), err)
+		return nil
+	}
+	volName, reuseVolume := existingSecretVolume(pod, serviceAccountName, key)
+	if !reuseVolume {
+		if volName, err = volumeNameFor(pod, serviceAccountName); err != nil {
+			log.Printf("rejecting annotation on pod/%s: %+v", pod.GetName(), err)
+			return nil
+		}
+	}
+	keyPath := path.Join(mountPath, key)
+	propagation, err := mountPropagationFor(pod)
+	if err != nil {
+		log.Printf("rejecting annotation on pod/%s: %+v", pod.GetName(), err)
+		return nil
+	}
+
+	// Accounts after the first are only mounted, next to the first one, as
+	// many as -max-injected-volumes allows.
+	if max := *maxInjectedVolumes; max > 0 && len(serviceAccountNames) > max {
+		log.Printf("warning: pod/%s requests %d service accounts, only injecting %s per -max-injected-volumes=%d",
+			pod.GetName(), len(serviceAccountNames), strings.Join(serviceAccountNames[:max], ","), max)
+		serviceAccountNames = serviceAccountNames[:max]
+	}
+	var additional []mountedAccount
+	for _, name := range serviceAccountNames[1:] {
+		a, err := additionalAccountFor(pod, name)
+		if err != nil {
+			log.Printf("rejecting annotation on pod/%s: %+v", pod.GetName(), err)
+			return nil
+		}
+		additional = append(additional, a)
+	}
+
+	var copyVolName string
+	if writableCopyRequested(pod) {
+		copyVolName = volName + "-writable"
+		if errs := validation.IsDNS1123Label(copyVolName); len(errs) > 0 {
+			log.Printf("rejecting annotation on pod/%s: invalid volume name %q: %s",
+				pod.GetName(), copyVolName, strings.Join(errs, "; "))
+			return nil
+		}
+	}
+
+	targets := targetContainers(pod)
+	if len(targets) == 0 {
+		log.Printf("no target containers in pod/%s", pod.GetName())
+		return nil
+	}
+
+	var tokenSecret string
+	if *credentialMode == credentialModeWorkloadIdentity {
+		if tokenSecret, ok = workloadIdentityTokenSecret(pod, serviceAccountName); !ok {
+			return nil
+		}
+	}
+
+	podEnv := append(topologyEnvVars(pod), profileEnvVars(pod)...)
+	raiseTerminationGracePeriod(&pod.Spec, *minTerminationGracePeriod)
+	if pod.ObjectMeta.Annotations == nil {
+		pod.ObjectMeta.Annotations = make(map[string]string)
+	}
+	pod.ObjectMeta.Annotations[versionAnnotation] = version
+	for _, c := range injectedContainers(pod, targets) {
+		c.Env = withoutEnv(c.Env, removeEnvNames)
+	}
+
+	if *credentialMode == credentialModeWorkloadIdentity {
+		if len(additional) > 0 {
+			log.Printf("warning: pod/%s can only run as serviceaccount/%s, ignoring additional accounts",
+				pod.GetName(), serviceAccountName)
+		}
+		useWorkloadIdentity(pod, serviceAccountName, tokenSecret)
+		for _, c := range injectedContainers(pod, targets) {
+			c.Env = injectEnv(c.Env, extraEnvVars(c.Env, podEnv)...)
+		}
+		return serviceAccountNames[:1]
+	}
+
+	if targetsVirtualNode(pod) || (!*disableEnvInjection && inlineCredentialsRequested(pod)) {
+		if len(additional) > 0 {
+			log.Printf("warning: only injecting secret/%s into pod/%s, additional accounts cannot be passed as env",
+				serviceAccountName, pod.GetName())
+		}
+		for _, c := range injectedContainers(pod, targets) {
+			// Importing the secret with envFrom does not expose the key, as
+			// its name is not a valid env var name, so it is always set.
+			var vars []corev1.EnvVar
+			for _, name := range credentialsEnvsFor(pod, c.Name) {
+				vars = append(vars, credentialsEnvVars(c, corev1.EnvVar{
+					Name: name + credentialsJSONSuffix,
+					ValueFrom: &corev1.EnvVarSource{
+						SecretKeyRef: &corev1.SecretKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{
+								Name: serviceAccountName},
+							Key: key}}})...)
+			}
+			c.Env = injectEnv(c.Env, append(vars, extraEnvVars(c.Env, podEnv)...)...)
+		}
+		return serviceAccountNames[:1]
+	}
+
+	if !reuseVolume {
+		pod.Spec.Volumes = append(pod.Spec.Volumes,
+			corev1.Volume{
+				Name: volName,
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{
+						SecretName: serviceAccountName,
+						Items: []corev1.KeyToPath{{
+							Key:  key,
+							Path: key,
+						}}}}})
+	}
+
+	for _, a := range additional {
+		if !a.reuseVolume {
+			pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+				Name: a.volName,
+				VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{
+						SecretName: a.name,
+						Items:      []corev1.KeyToPath{{Key: a.key, Path: a.key}}}}})
+		}
+	}
+
+	// With a writable copy, containers mount the emptyDir in place of the
+	// secret, so the key path stays the same.
+	mountVolName := volName
+	if copyVolName != "" {
+		addWritableCopy(pod, volName, copyVolName, mountPath, key)
+		mountVolName = copyVolName
+	}
+
+	for _, c := range injectedContainers(pod, targets) {
+		// With -existing-credentials-env=mount, only the key file is mounted
+		// where the container's own env var expects it.
+		containerMountPath, subPath := mountPath, ""
+		if p, ok := existingCredentialsPath(*c, credentialsEnvsFor(pod, c.Name)); ok {
+			containerMountPath, subPath = p, key
+		}
+		// The mount is already there if the pod was injected before.
+		if !hasVolumeMount(*c, containerMountPath) {
+			c.VolumeMounts = append(c.VolumeMounts,
+				corev1.VolumeMount{
+					Name:             mountVolName,
+					MountPath:        containerMountPath,
+					SubPath:          subPath,
+					ReadOnly:         copyVolName == "",
+					MountPropagation: propagation})
+		}
+		for _, a := range additional {
+			if !hasVolumeMount(*c, a.mountPath) {
+				c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+					Name:             a.volName,
+					MountPath:        a.mountPath,
+					ReadOnly:         true,
+					MountPropagation: propagation})
+			}
+		}
+		if *disableEnvInjection {
+			continue
+		}
+
+		var vars []corev1.EnvVar
+		for _, name := range credentialsEnvsFor(pod, c.Name) {
+			vars = append(vars, credentialsEnvVars(c, corev1.EnvVar{Name: name, Value: keyPath})...)
+		}
+		c.Env = injectEnv(c.Env, append(vars, extraEnvVars(c.Env, podEnv)...)...)
+	}
+
+	if *expiryMonitorImage != "" {
+		if runsToCompletion(pod) {
+			log.Printf("not adding the expiry monitor to pod/%s, its restartPolicy is %s",
+				pod.GetName(), pod.Spec.RestartPolicy)
+		} else {
+			addExpiryMonitor(pod, volName, mountPath, keyPath)
+		}
+	}
+
+	return serviceAccountNames
+}
+
+// workloadIdentityTokenSecret checks that the pod can be switched to the
+// Kubernetes ServiceAccount ksaName with useWorkloadIdentity, and returns the
+// API token secret of ksaName to mount instead of the one the ServiceAccount
+// admission plugin already mounted for the pod's original ServiceAccount, or
+// "" if there is none. A pod already running as a non-default ServiceAccount
+// keeps it, and pods that cannot be switched are left alone.
+func workloadIdentityTokenSecret(pod *corev1.Pod, ksaName string) (string, bool) {
+	if current := ksaNameFor(pod); current != "default" {
+		if current != ksaName {
+			log.Printf("warning: pod/%s keeps serviceaccount/%s instead of %s",
+				pod.GetName(), current, ksaName)
+		}
+		return "", false
+	}
+
+	// Without a lister (e.g. the snippet subcommand) the ServiceAccount is
+	// not checked, but its token cannot be found either.
+	var ksa *corev1.ServiceAccount
+	if serviceAccountLister != nil {
+		var err error
+		if ksa, err = serviceAccountLister.ServiceAccounts(pod.GetNamespace()).Get(ksaName); err != nil {
+			log.Printf("not switching pod/%s to serviceaccount/%s: %+v", pod.GetName(), ksaName, err)
+			return "", false
+		}
+	}
+
+	vol := tokenVolume(pod)
+	if vol == nil {
+		return "", true
+	}
+	if vol.Secret == nil || ksa == nil {
+		log.Printf("not switching pod/%s to serviceaccount/%s: cannot replace its API token volume %s",
+			pod.GetName(), ksaName, vol.Name)
+		return "", false
+	}
+	for _, ref := range ksa.Secrets {
+		if strings.HasPrefix(ref.Name, ksaName+"-token-") {
+			return ref.Name, true
+		}
+	}
+	log.Printf("not switching pod/%s to serviceaccount/%s: it has no API token secret",
+		pod.GetName(), ksaName)
+	return "", false
+}
+
+// tokenVolume returns the volume the ServiceAccount admission plugin mounted
+// the pod's API token from, or nil if the token is not mounted.
+func tokenVolume(pod *corev1.Pod) *corev1.Volume {
+	for _, containers := range [][]corev1.Container{pod.Spec.InitContainers, pod.Spec.Containers} {
+		for _, c := range containers {
+			for _, m := range c.VolumeMounts {
+				if m.MountPath != serviceAccountTokenPath {
+					continue
+				}
+				for i := range pod.Spec.Volumes {
+					if pod.Spec.Volumes[i].Name == m.Name {
+						return &pod.Spec.Volumes[i]
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// useWorkloadIdentity runs the pod as the Kubernetes ServiceAccount ksaName,
+// which Workload Identity is expected to bind to the GCP service account, so
+// no key needs to be mounted. The pod's API token volume, if any, is switched
+// to tokenSecret, as checked by workloadIdentityTokenSecret.
+func useWorkloadIdentity(pod *corev1.Pod, ksaName, tokenSecret string) {
+	pod.Spec.ServiceAccountName = ksaName
+	pod.Spec.DeprecatedServiceAccount = ksaName
+	if vol := tokenVolume(pod); vol != nil && tokenSecret != "" {
+		vol.Secret.SecretName = tokenSecret
+	}
+}
+
+// inlineCredentialsRequested reports whether the key is injected as the
+// credentialsJSONSuffix variables rather than mounted, per the
+// "iam.cloud.google.com/inline-credentials" annotation or -inline-credentials.
+func inlineCredentialsRequested(pod *corev1.Pod) bool {
+	v, ok := pod.ObjectMeta.Annotations[inlineAnnotation]
+	if !ok {
+		return *inlineCredentials
+	}
+	inline, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("invalid %s value %q on pod/%s, using -inline-credentials=%v",
+			inlineAnnotation, v, pod.GetName(), *inlineCredentials)
+		return *inlineCredentials
+	}
+	return inline
+}
+
+// mountedAccount is an additional service account mounted into a pod.
+type mountedAccount struct {
+	name, key, volName, mountPath string
+	// reuseVolume is set if the pod already has a volume for the secret.
+	reuseVolume bool
+}
+
+// additionalAccountFor returns where the named additional account is mounted:
+// at its own mount path, from an existing volume of the secret or a new
+// "gcp-<name>" volume.
+func additionalAccountFor(pod *corev1.Pod, name string) (mountedAccount, error) {
+	mountPath, err := mountPathFor(name)
+	if err != nil {
+		return mountedAccount{}, err
+	}
+	key, err := secretKeyFor(pod, name)
+	if err != nil {
+		return mountedAccount{}, err
+	}
+	volName, reuse := existingSecretVolume(pod, name, key)
+	if !reuse {
+		volName = "gcp-" + name
+		if errs := validation.IsDNS1123Label(volName); len(errs) > 0 {
+			return mountedAccount{}, fmt.Errorf("invalid volume name %q: %s", volName, strings.Join(errs, "; "))
+		}
+		if hasVolume(pod.Spec, volName) {
+			return mountedAccount{}, fmt.Errorf("volume name %q is already used in the pod", volName)
+		}
+	}
+	return mountedAccount{name: name, key: key, volName: volName, mountPath: mountPath, reuseVolume: reuse}, nil
+}
+
+// writableCopyRequested reports whether the pod asks for a writable copy of
+// the key with an "iam.cloud.google.com/writable-copy" annotation.
+func writableCopyRequested(pod *corev1.Pod) bool {
+	v, ok := pod.ObjectMeta.Annotations[writableAnnotation]
+	if !ok {
+		return false
+	}
+	writable, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("invalid %s value %q on pod/%s, mounting read-only", writableAnnotation, v, pod.GetName())
+		return false
+	}
+	return writable
+}
+
+// addWritableCopy adds the copyVolName emptyDir and an init container, run
+// before any other, that copies the key from the secret volume into it.
+func addWritableCopy(pod *corev1.Pod, secretVolName, copyVolName, mountPath, key string) {
+	if hasVolume(pod.Spec, copyVolName) {
+		return
+	}
+	pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+		Name: copyVolName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{}}})
+	copier := corev1.Container{
+		Name:    copyContainerName,
+		Image:   *copyImage,
+		Command: []string{"cp", path.Join(mountPath, key), path.Join(copyTargetPath, key)},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: secretVolName, MountPath: mountPath, ReadOnly: true},
+			{Name: copyVolName, MountPath: copyTargetPath}}}
+	pod.Spec.InitContainers = append([]corev1.Container{copier}, pod.Spec.InitContainers...)
+}
+
+// addExpiryMonitor adds the -expiry-monitor-image sidecar, which reads the
+// key file at keyPath, and labels the pod so its metrics can be scraped.
+func addExpiryMonitor(pod *corev1.Pod, volName, mountPath, keyPath string) {
+	for _, c := range pod.Spec.Containers {
+		if c.Name == expiryMonitorName {
+			return
+		}
+	}
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+		Name:  expiryMonitorName,
+		Image: *expiryMonitorImage,
+		Env: []corev1.EnvVar{{
+			Name:  credentialsEnv,
+			Value: keyPath}},
+		VolumeMounts: []corev1.VolumeMount{{
+			Name:      volName,
+			MountPath: mountPath,
+			ReadOnly:  true}}})
+	if pod.Labels == nil {
+		pod.Labels = map[string]string{}
+	}
+	pod.Labels[expiryMonitorLabel] = "true"
+}
+
+// runsToCompletion reports whether the pod is meant to terminate, i.e. its
+// restart policy is not Always. A long-running sidecar would keep such a pod,
+// and the Job it belongs to, from ever completing. Job and CronJob templates
+// must use Never or OnFailure, so they are always covered.
+func runsToCompletion(pod *corev1.Pod) bool {
+	return pod.Spec.RestartPolicy != "" && pod.Spec.RestartPolicy != corev1.RestartPolicyAlways
+}
+
+// existingSecretVolume returns the name of a volume the user already declared
+// for the service account secret, so it can be mounted instead of adding a
+// duplicate. The volume must expose the key file under its own name.
+func existingSecretVolume(pod *corev1.Pod, serviceAccountName, key string) (string, bool) {
+	for _, v := range pod.Spec.Volumes {
+		if v.Secret == nil || v.Secret.SecretName != serviceAccountName {
+			continue
+		}
+		if len(v.Secret.Items) == 0 {
+			return v.Name, true
+		}
+		for _, item := range v.Secret.Items {
+			if item.Key == key && item.Path == key {
+				return v.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// secretKeyFor returns the key of the named secret holding the credentials,
+// which is also the name of the mounted file: the key listed for the secret
+// in an "iam.cloud.google.com/secret-keys" annotation (e.g.
+// "sa-a:a.json,sa-b:b.json"), else the "iam.cloud.google.com/secret-key"
+// annotation, else -secret-key.
+func secretKeyFor(pod *corev1.Pod, serviceAccountName string) (string, error) {
+	keys, err := secretKeysFor(pod)
+	if err != nil {
+		return "", err
+	}
+	key, ok := keys[serviceAccountName]
+	if !ok {
+		key, ok = pod.ObjectMeta.Annotations[secretKeyAnnotation]
+	}
+	if !ok {
+		return *secretKey, nil
+	}
+	if errs := validation.IsConfigMapKey(key); len(errs) > 0 {
+		return "", fmt.Errorf("invalid secret key %q: %s", key, strings.Join(errs, "; "))
+	}
+	return key, nil
+}
+
+// secretKeysFor parses the pod's "iam.cloud.google.com/secret-keys"
+// annotation, a comma-separated list of secret:key pairs.
+func secretKeysFor(pod *corev1.Pod) (map[string]string, error) {
+	v, ok := pod.ObjectMeta.Annotations[secretKeysAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	keys := make(map[string]string)
+	for _, pair := range strings.Split(v, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid %s entry %q, expected secret:key", secretKeysAnnotation, pair)
+		}
+		keys[parts[0]] = parts[1]
+	}
+	return keys, nil
+}
+
+// volumeNameFor returns the name of the injected volume: "gcp-<name>" unless
+// overridden with an "iam.cloud.google.com/volume-name" annotation, which
+// must not be already used by another volume in the pod. Either must be a
+// DNS-1123 label, which secret names containing dots, for instance, are not.
+func volumeNameFor(pod *corev1.Pod, serviceAccountName string) (string, error) {
+	name, ok := pod.ObjectMeta.Annotations[volumeAnnotation]
+	if !ok {
+		name = fmt.Sprintf("gcp-%s", serviceAccountName)
+	}
+	if errs := validation.IsDNS1123Label(name); len(errs) > 0 {
+		return "", fmt.Errorf("invalid volume name %q: %s", name, strings.Join(errs, "; "))
+	}
+	if !ok {
+		return name, nil
+	}
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == name {
+			return "", fmt.Errorf("volume name %q is already used in the pod", name)
+		}
+	}
+	return name, nil
+}
+
+// mountPropagationFor returns the mount propagation mode requested with an
+// "iam.cloud.google.com/mount-propagation" annotation, or nil if unset.
+func mountPropagationFor(pod *corev1.Pod) (*corev1.MountPropagationMode, error) {
+	v, ok := pod.ObjectMeta.Annotations[propagationAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	mode := corev1.MountPropagationMode(v)
+	switch mode {
+	case corev1.MountPropagationNone, corev1.MountPropagationHostToContainer, corev1.MountPropagationBidirectional:
+		return &mode, nil
+	}
+	return nil, fmt.Errorf("invalid mount propagation %q, must be one of %s, %s or %s", v,
+		corev1.MountPropagationNone, corev1.MountPropagationHostToContainer, corev1.MountPropagationBidirectional)
+}
+
+// targetContainers returns the indexes of the pod's containers that
+// credentials should be injected into. -target-container-port and
+// -target-image-substring restrict the eligible containers to those declaring
+// that port and/or whose image contains the substring, and -deny-privileged
+// excludes privileged containers. Of these, only the first and the ones named
+// in an "iam.cloud.google.com/env.<container>" annotation are targeted unless
+// -inject-all-containers is set. An "iam.cloud.google.com/containers"
+// annotation listing container names replaces this selection.
+func targetContainers(pod *corev1.Pod) []int {
+	named, restricted := namedContainers(pod)
+	targets := make([]int, 0, len(pod.Spec.Containers))
+	for i, c := range pod.Spec.Containers {
+		if restricted {
+			if !named[c.Name] {
+				continue
+			}
+		} else if !*injectAllContainers && len(targets) > 0 {
+			if _, annotated := pod.ObjectMeta.Annotations[envAnnotation+c.Name]; !annotated {
+				continue
+			}
+		}
+		if *denyPrivileged && isPrivileged(c) {
+			log.Printf("warning: not injecting into privileged container %s in pod/%s",
+				c.Name, pod.GetName())
+			continue
+		}
+		if *targetContainerPort != 0 && !exposesPort(c, int32(*targetContainerPort)) {
+			continue
+		}
+		if *targetImageSubstring != "" && !strings.Contains(c.Image, *targetImageSubstring) {
+			continue
+		}
+		targets = append(targets, i)
+	}
+	return targets
+}
+
+// injectedContainers returns the containers to inject: the targets, indices
+// into pod.Spec.Containers, preceded by the init containers if the pod is
+// annotated "iam.cloud.google.com/inject-init-containers=true". The writable
+// copy's init container and, with -deny-privileged, privileged init containers
+// are left out. The pointers are only valid until the container lists change.
+func injectedContainers(pod *corev1.Pod, targets []int) []*corev1.Container {
+	containers := make([]*corev1.Container, 0, len(pod.Spec.InitContainers)+len(targets))
+	if initContainersRequested(pod) {
+		for i := range pod.Spec.InitContainers {
+			c := &pod.Spec.InitContainers[i]
+			if c.Name == copyContainerName {
+				continue
+			}
+			if *denyPrivileged && isPrivileged(*c) {
+				log.Printf("warning: not injecting into privileged init container %s in pod/%s",
+					c.Name, pod.GetName())
+				continue
+			}
+			containers = append(containers, c)
+		}
+	}
+	for _, i := range targets {
+		containers = append(containers, &pod.Spec.Containers[i])
+	}
+	return containers
+}
+
+// initContainersRequested reports whether the pod asks for its init containers
+// to be injected with an "iam.cloud.google.com/inject-init-containers"
+// annotation.
+func initContainersRequested(pod *corev1.Pod) bool {
+	v, ok := pod.ObjectMeta.Annotations[initAnnotation]
+	if !ok {
+		return false
+	}
+	inject, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("invalid %s value %q on pod/%s, not injecting init containers", initAnnotation, v, pod.GetName())
+		return false
+	}
+	return inject
+}
+
+// namedContainers returns the set of container names listed in the pod's
+// "iam.cloud.google.com/containers" annotation, and whether it is set. Names
+// not matching any container are logged.
+func namedContainers(pod *corev1.Pod) (map[string]bool, bool) {
+	v, ok := pod.ObjectMeta.Annotations[containersAnnotation]
+	if !ok {
+		return nil, false
+	}
+	exists := make(map[string]bool, len(pod.Spec.Containers))
+	for _, c := range pod.Spec.Containers {
+		exists[c.Name] = true
+	}
+	named := make(map[string]bool)
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !exists[name] {
+			log.Printf("warning: %s on pod/%s names unknown container %q", containersAnnotation, pod.GetName(), name)
+		}
+		named[name] = true
+	}
+	return named, true
+}
+
+// isPrivileged reports whether the container runs in privileged mode.
+func isPrivileged(c corev1.Container) bool {
+	return c.SecurityContext != nil && c.SecurityContext.Privileged != nil &&
+		*c.SecurityContext.Privileged
+}
+
+// exposesPort reports whether the container declares the given port.
+func exposesPort(c corev1.Container, port int32) bool {
+	for _, p := range c.Ports {
+		if p.ContainerPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+// credentialsEnvsFor returns the env var names the key path is exposed as in
+// the named container: those of -credentials-env-name, or the single name of
+// an "iam.cloud.google.com/env.<container>" annotation.
+func credentialsEnvsFor(pod *corev1.Pod, containerName string) []string {
+	name, ok := pod.ObjectMeta.Annotations[envAnnotation+containerName]
+	if !ok {
+		return credentialsEnvNames
+	}
+	if errs := validation.IsEnvVarName(name); len(errs) > 0 {
+		log.Printf("ignoring invalid env var name %q for container %s in pod/%s: %s",
+			name, containerName, pod.GetName(), strings.Join(errs, "; "))
+		return credentialsEnvNames
+	}
+	return []string{name}
+}
+
+// raiseTerminationGracePeriod sets the pod's termination grace period to min
+// seconds if it is currently lower. A zero min leaves the spec untouched.
+func raiseTerminationGracePeriod(spec *corev1.PodSpec, min int64) {
+	if min <= 0 {
+		return
+	}
+	if spec.TerminationGracePeriodSeconds == nil || *spec.TerminationGracePeriodSeconds < min {
+		spec.TerminationGracePeriodSeconds = &min
+	}
+}
+
+// targetsVirtualNode reports whether the pod can only run on a Virtual Kubelet
+// node, based on its node selector and required node affinity. Pods are not
+// yet scheduled when they are initialized, so this is the best signal
+// available. A toleration of the Virtual Kubelet taint alone does not count,
+// as it only allows the pod to run there.
+func targetsVirtualNode(pod *corev1.Pod) bool {
+	if pod.Spec.NodeSelector[virtualNodeLabel] == virtualNodeLabelValue {
+		return true
+	}
+	if pod.Spec.Affinity == nil || pod.Spec.Affinity.NodeAffinity == nil ||
+		pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return false
+	}
+	// Terms are ORed, so every one of them must require the label.
+	terms := pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	for _, term := range terms {
+		if !requiresVirtualNode(term) {
+			return false
+		}
+	}
+	return len(terms) > 0
+}
+
+// requiresVirtualNode reports whether a node selector term only matches
+// nodes carrying the Virtual Kubelet label.
+func requiresVirtualNode(term corev1.NodeSelectorTerm) bool {
+	for _, r := range term.MatchExpressions {
+		if r.Key != virtualNodeLabel || r.Operator != corev1.NodeSelectorOpIn {
+			continue
+		}
+		if len(r.Values) == 1 && r.Values[0] == virtualNodeLabelValue {
+			return true
+		}
+	}
+	return false
+}
+
+// validateAnnotationLengths rejects values of our annotations longer than
+// -max-annotation-length, which could otherwise produce huge patches.
+func validateAnnotationLengths(annotations map[string]string) error {
+	for k, v := range annotations {
+		if strings.HasPrefix(k, annotationPrefix) && len(v) > *maxAnnotationLength {
+			return fmt.Errorf("value of %s is %d bytes, exceeding the maximum of %d",
+				k, len(v), *maxAnnotationLength)
+		}
+	}
+	return nil
+}
+
+// injectionEnabled reports whether injection is enabled for the pod. Pods can
+// opt out with an "iam.cloud.google.com/inject" annotation, mirroring the
+// sidecar.istio.io/inject convention. Values that are not booleans disable
+// injection.
+func injectionEnabled(pod *corev1.Pod) bool {
+	v, ok := pod.ObjectMeta.Annotations[injectAnnotation]
+	if !ok {
+		return true
+	}
+	enabled, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("invalid %s value %q on pod/%s, not injecting", injectAnnotation, v, pod.GetName())
+		return false
+	}
+	return enabled
+}
+
+// skipReason returns the initializer_decisions_total reason for leaving the
+// pod without injection. Pods whose annotations request a service account
+// that was not injected are counted as invalid_annotation, as modifyPodSpec
+// logged.
+func skipReason(pod *corev1.Pod) string {
+	if !namespaceSelected(pod.GetNamespace()) {
+		return reasonExcludedNamespace
+	}
+	if v, ok := pod.ObjectMeta.Annotations[injectAnnotation]; ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return reasonInvalidAnnotation
+		}
+		if !enabled {
+			return reasonOptOut
+		}
+	}
+	if usesWorkloadIdentity(pod) {
+		return reasonWorkloadIdentity
+	}
+	if len(serviceAccountCandidates(pod)) == 0 {
+		return reasonNoAnnotation
+	}
+	return reasonInvalidAnnotation
+}
+
+// unknownAnnotations returns the keys under annotationPrefix that are not
+// known to the initializer, which usually indicates a typo.
+func unknownAnnotations(annotations map[string]string) []string {
+	var unknown []string
+	for k := range annotations {
+		if strings.HasPrefix(k, annotationPrefix) && !isKnownAnnotation(k) {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+func isKnownAnnotation(key string) bool {
+	for _, k := range knownAnnotations {
+		if key == k {
+			return true
+		}
+	}
+	for _, p := range knownAnnotationPrefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// gcpServiceAccountFor returns the primary service account secret name to
+// inject into the pod, the first of gcpServiceAccountsFor.
+func gcpServiceAccountFor(pod *corev1.Pod) (string, bool) {
+	names, ok := gcpServiceAccountsFor(pod)
+	if !ok {
+		return "", false
+	}
+	return names[0], true
+}
+
+// gcpServiceAccountsFor returns the service account secret names to inject
+// into the pod, given as a comma-separated list. The pod's own annotation
+// takes precedence, then the service account of its profile, then the
+// annotation on the pod's Kubernetes ServiceAccount (if watched), then the
+// -ksa-mapping-configmap entry for it, then the default secret configured
+// for the pod's namespace. With -secret-fallback, candidates whose secrets
+// do not all exist are passed over; if none qualifies the first one is
+// returned.
+func gcpServiceAccountsFor(pod *corev1.Pod) ([]string, bool) {
+	candidates := serviceAccountCandidates(pod)
+	if len(candidates) == 0 {
+		return nil, false
+	}
+	if *secretFallback && secretLister != nil {
+		for _, c := range candidates {
+			if names := splitServiceAccounts(c); secretsListed(pod.GetNamespace(), names) {
+				return names, true
+			}
+		}
+		log.Printf("warning: none of the secrets %s exist for pod/%s, using %s",
+			strings.Join(candidates, ", "), pod.GetName(), candidates[0])
+	}
+	return splitServiceAccounts(candidates[0]), true
+}
+
+// splitServiceAccounts splits a comma-separated list of secret names,
+// dropping duplicates.
+func splitServiceAccounts(v string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// secretsListed reports whether all the named secrets are in secretLister.
+func secretsListed(namespace string, names []string) bool {
+	for _, name := range names {
+		_, err := secretLister.Secrets(namespace).Get(name)
+		if err != nil {
+			if !apierrors.IsNotFound(err) {
+				log.Printf("failed to get secret/%s in namespace %s: %+v", name, namespace, err)
+			}
+			return false
+		}
+	}
 	return true
 }
+
+// serviceAccountCandidates returns the secret names configured for the pod by
+// each source, in order of precedence.
+func serviceAccountCandidates(pod *corev1.Pod) []string {
+	var candidates []string
+	if name, ok := serviceAccountAnnotation(pod.ObjectMeta.Annotations); ok {
+		candidates = append(candidates, name)
+	}
+	if name, ok := profileServiceAccountFor(pod); ok {
+		candidates = append(candidates, name)
+	}
+	if name, ok := ksaServiceAccountFor(pod); ok {
+		candidates = append(candidates, name)
+	}
+	if name, ok := mappedServiceAccountFor(pod); ok {
+		candidates = append(candidates, name)
+	}
+	if name, ok := namespaceDefaultSecrets[pod.GetNamespace()]; ok {
+		candidates = append(candidates, name)
+	}
+	return candidates
+}
+
+// ksaNameFor returns the name of the pod's Kubernetes ServiceAccount.
+func ksaNameFor(pod *corev1.Pod) string {
+	if pod.Spec.ServiceAccountName == "" {
+		return "default"
+	}
+	return pod.Spec.ServiceAccountName
+}
+
+// mappedServiceAccountFor returns the secret the -ksa-mapping-configmap maps
+// the pod's Kubernetes ServiceAccount to. The ConfigMap is read from the
+// lister on every call, so changes to it apply to the next pods.
+func mappedServiceAccountFor(pod *corev1.Pod) (string, bool) {
+	if configMapLister == nil {
+		return "", false
+	}
+	cm, err := configMapLister.ConfigMaps(ksaMappingNamespace).Get(ksaMappingName)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Printf("failed to get configmap %s: %+v", *ksaMappingConfigMap, err)
+		}
+		return "", false
+	}
+	name, ok := cm.Data[ksaNameFor(pod)]
+	return name, ok
+}
+
+// ksaServiceAccountFor returns the annotation set on the pod's Kubernetes
+// ServiceAccount, if -watch-serviceaccounts is enabled.
+func ksaServiceAccountFor(pod *corev1.Pod) (string, bool) {
+	if !*watchServiceAccounts {
+		return "", false
+	}
+	ksa, ok := ksaFor(pod)
+	if !ok {
+		return "", false
+	}
+	return serviceAccountAnnotation(ksa.ObjectMeta.Annotations)
+}
+
+// usesWorkloadIdentity reports whether the pod's Kubernetes ServiceAccount is
+// bound to a GCP service account with Workload Identity, if
+// -skip-workload-identity is enabled.
+func usesWorkloadIdentity(pod *corev1.Pod) bool {
+	if !*skipWorkloadIdentity {
+		return false
+	}
+	ksa, ok := ksaFor(pod)
+	if !ok {
+		return false
+	}
+	return ksa.ObjectMeta.Annotations[workloadIdentityAnnotation] != ""
+}
+
+// ksaFor looks up the pod's Kubernetes ServiceAccount in
+// serviceAccountLister.
+func ksaFor(pod *corev1.Pod) (*corev1.ServiceAccount, bool) {
+	if serviceAccountLister == nil {
+		return nil, false
+	}
+
+	ksaName := ksaNameFor(pod)
+	ksa, err := serviceAccountLister.ServiceAccounts(pod.GetNamespace()).Get(ksaName)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Printf("failed to get serviceaccount/%s for pod/%s: %+v",
+				ksaName, pod.GetName(), err)
+		}
+		return nil, false
+	}
+	return ksa, true
+}
+
+// serviceAccountAnnotation returns the secret name set with annotation, or
+// with legacyAnnotation if only the deprecated key is present.
+func serviceAccountAnnotation(annotations map[string]string) (string, bool) {
+	if name, ok := annotations[annotation]; ok {
+		return name, true
+	}
+	name, ok := annotations[legacyAnnotation]
+	return name, ok
+}
+
+// secretExists reports whether the named secret exists. Answers are cached
+// for secretLookupTTL so a burst of pods using the same secret costs a single
+// API request, and at most -max-concurrent-secret-lookups requests are in
+// flight. Lookup failures other than NotFound count as existing.
+func secretExists(clientset kubernetes.Interface, namespace, name string) bool {
+	key := namespace + "/" + name
+	if v, ok := secretLookups.Get(key); ok {
+		return v.(bool)
+	}
+	if secretLookupSlots != nil {
+		secretLookupSlots <- struct{}{}
+		defer func() { <-secretLookupSlots }()
+		// Another worker may have looked it up while this one waited.
+		if v, ok := secretLookups.Get(key); ok {
+			return v.(bool)
+		}
+	}
+	_, err := clientset.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.Printf("failed to get secret/%s in namespace %s: %+v", name, namespace, err)
+		return true
+	}
+	secretLookups.Add(key, err == nil, secretLookupTTL)
+	return err == nil
+}
+
+// secretMountable reports whether the secret may be injected. With
+// -require-secret-label only existing secrets matching the selector are
+// mountable; without a lister (e.g. the snippet subcommand) the check is
+// skipped.
+func secretMountable(namespace, name string) bool {
+	if requiredSecretSelector == nil || secretLister == nil {
+		return true
+	}
+	secret, err := secretLister.Secrets(namespace).Get(name)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			log.Printf("failed to get secret/%s in namespace %s: %+v", name, namespace, err)
+		}
+		return false
+	}
+	return requiredSecretSelector.Matches(labels.Set(secret.ObjectMeta.Labels))
+}
+
+// cloudSDKEnvVars returns the -cloudsdk-env variables, sorted by name, that
+// are not already set in env.
+func cloudSDKEnvVars(env []corev1.EnvVar) []corev1.EnvVar {
+	var names []string
+	for name := range cloudSDKEnvValues {
+		if !hasEnv(env, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	vars := make([]corev1.EnvVar, 0, len(names))
+	for _, name := range names {
+		vars = append(vars, corev1.EnvVar{Name: name, Value: cloudSDKEnvValues[name]})
+	}
+	return vars
+}
+
+// topologyEnvVars returns GCP_REGION/GCP_ZONE env vars for the node the pod
+// will run on, when -inject-topology-env is enabled. Pods are usually not
+// scheduled yet when initialized, so this is best-effort: the node is taken
+// from spec.nodeName if set, otherwise the topology labels are read from the
+// pod's node selector.
+func topologyEnvVars(pod *corev1.Pod) []corev1.EnvVar {
+	if !*injectTopologyEnv {
+		return nil
+	}
+
+	labels := pod.Spec.NodeSelector
+	if pod.Spec.NodeName != "" && nodeLister != nil {
+		node, err := nodeLister.Get(pod.Spec.NodeName)
+		if err != nil {
+			log.Printf("failed to get node/%s for pod/%s: %+v", pod.Spec.NodeName, pod.GetName(), err)
+		} else {
+			labels = node.GetLabels()
+		}
+	}
+
+	var vars []corev1.EnvVar
+	if region := firstLabel(labels, regionLabel, deprecatedRegionLabel); region != "" {
+		vars = append(vars, corev1.EnvVar{Name: regionEnv, Value: region})
+	}
+	if zone := firstLabel(labels, zoneLabel, deprecatedZoneLabel); zone != "" {
+		vars = append(vars, corev1.EnvVar{Name: zoneEnv, Value: zone})
+	}
+	return vars
+}
+
+// firstLabel returns the value of the first of keys set in labels.
+func firstLabel(labels map[string]string, keys ...string) string {
+	for _, k := range keys {
+		if v, ok := labels[k]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// extraEnvVars returns the optional env vars (-cloudsdk-env, and the
+// topology and profile vars in pod) that are not already set in env.
+func extraEnvVars(env []corev1.EnvVar, pod []corev1.EnvVar) []corev1.EnvVar {
+	vars := cloudSDKEnvVars(env)
+	for _, v := range pod {
+		if !hasEnv(env, v.Name) && !hasEnv(vars, v.Name) {
+			vars = append(vars, v)
+		}
+	}
+	return vars
+}
+
+// hasVolumeMount reports whether the container mounts a volume at mountPath.
+func hasVolumeMount(c corev1.Container, mountPath string) bool {
+	for _, m := range c.VolumeMounts {
+		if m.MountPath == mountPath {
+			return true
+		}
+	}
+	return false
+}
+
+// hasEnv reports whether env contains a variable with the given name.
+func hasEnv(env []corev1.EnvVar, name string) bool {
+	for _, e := range env {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// existingCredentialsPath returns the absolute path that c already sets the
+// first of the credentials env vars envNames to, if
+// -existing-credentials-env=mount.
+func existingCredentialsPath(c corev1.Container, envNames []string) (string, bool) {
+	if *existingCredentialsEnv != existingEnvMount {
+		return "", false
+	}
+	for _, envName := range envNames {
+		for _, e := range c.Env {
+			if e.Name != envName || e.ValueFrom != nil {
+				continue
+			}
+			p := path.Clean(e.Value)
+			if !path.IsAbs(p) || p == "/" {
+				log.Printf("warning: ignoring %s=%q in container %s, not an absolute file path", envName, e.Value, c.Name)
+				return "", false
+			}
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// credentialsEnvVars returns the credentials variable cred to inject into c.
+// If c already sets a variable of that name, nothing is returned and the
+// existing one is kept or, with -existing-credentials-env=overwrite, replaced
+// in place by cred.
+func credentialsEnvVars(c *corev1.Container, cred corev1.EnvVar) []corev1.EnvVar {
+	for i := range c.Env {
+		if c.Env[i].Name != cred.Name {
+			continue
+		}
+		if *existingCredentialsEnv == existingEnvOverwrite {
+			c.Env[i] = cred
+		}
+		return nil
+	}
+	return []corev1.EnvVar{cred}
+}
+
+// withoutEnv returns env without the variables named in names.
+func withoutEnv(env []corev1.EnvVar, names map[string]bool) []corev1.EnvVar {
+	if len(names) == 0 {
+		return env
+	}
+	var kept []corev1.EnvVar
+	for _, e := range env {
+		if !names[e.Name] {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// injectEnv adds vars to env at the position selected by -env-inject-order.
+// The result is allocated once and never aliases vars, so callers can pass a
+// short-lived slice.
+func injectEnv(env []corev1.EnvVar, vars ...corev1.EnvVar) []corev1.EnvVar {
+	out := make([]corev1.EnvVar, 0, len(env)+len(vars))
+	if *envInjectOrder == envInjectPrepend {
+		return append(append(out, vars...), env...)
+	}
+	return append(append(out, env...), vars...)
+}
+
+// mountPathFor computes the directory the service account secret is mounted
+// at, below -mount-path and -default-mount-subdir. It returns an error if
+// the annotation value would place the mount outside of that root (e.g.
+// "../../etc").
+func mountPathFor(serviceAccountName string) (string, error) {
+	root := path.Join(*baseMountPath, *defaultMountSubdir)
+	mountPath := path.Join(root, serviceAccountName)
+	if !withinRoot(root, mountPath) {
+		return "", fmt.Errorf("mount path for %q escapes %s", serviceAccountName, root)
+	}
+	return mountPath, nil
+}
+
+// withinRoot reports whether p, after path.Clean, is strictly below root.
+func withinRoot(root, p string) bool {
+	root, p = path.Clean(root), path.Clean(p)
+	return p != root && strings.HasPrefix(p, strings.TrimSuffix(root, "/")+"/")
+}
@@ -12,12 +12,37 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilcache "k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
 func Test_needsInitialization(t *testing.T) {
@@ -49,6 +74,54 @@ func Test_needsInitialization(t *testing.T) {
 	}
 }
 
+func Test_needsInitialization_maxPending(t *testing.T) {
+	defer func(v int) { *maxPendingInitializers = v }(*maxPendingInitializers)
+
+	newPod := func(pending int) *corev1.Pod {
+		initializers := []metav1.Initializer{{Name: "serviceaccounts.cloud.google.com"}}
+		for i := 1; i < pending; i++ {
+			initializers = append(initializers, metav1.Initializer{Name: fmt.Sprintf("other-%d", i)})
+		}
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Initializers: &metav1.Initializers{Pending: initializers}}}
+	}
+	tests := []struct {
+		name    string
+		max     int
+		pending int
+		want    bool
+	}{
+		{"below max", 3, 2, true},
+		{"at max", 3, 3, true},
+		{"exceeds max", 3, 4, false},
+		{"check disabled", 0, 1000, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*maxPendingInitializers = tt.max
+			assert.Equal(t, tt.want, needsInitialization(newPod(tt.pending)))
+		})
+	}
+}
+
+func Test_pendingOnly_maxPendingWarnsOnce(t *testing.T) {
+	defer func(v int) { *maxPendingInitializers = v }(*maxPendingInitializers)
+	*maxPendingInitializers = 1
+	defer log.SetOutput(log.StandardLogger().Out)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+
+	handler := pendingOnly(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) { t.Errorf("%s was not skipped", obj.(*corev1.Pod).GetName()) },
+	})
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", UID: "max-pending-warns-once",
+		Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+			{Name: "serviceaccounts.cloud.google.com"}, {Name: "other"}}}}}
+	handler.OnAdd(pod)
+	handler.OnUpdate(pod, pod)
+	assert.Equal(t, 1, strings.Count(buf.String(), "exceed -max-pending-initializers"))
+}
+
 func Test_removeSelfPendingInitializer(t *testing.T) {
 	tests := []struct {
 		name string
@@ -114,7 +187,7 @@ func Test_modifyPodSpec(t *testing.T) {
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "foo",
 					Annotations: map[string]string{
-						"foo": "bar",
+						"foo":                                  "bar",
 						"iam.cloud.google.com/service-account": "sa-1",
 					}},
 				Spec: corev1.PodSpec{
@@ -125,8 +198,9 @@ func Test_modifyPodSpec(t *testing.T) {
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "foo",
 					Annotations: map[string]string{
-						"foo": "bar",
-						"iam.cloud.google.com/service-account": "sa-1",
+						"foo":                                   "bar",
+						"iam.cloud.google.com/service-account":  "sa-1",
+						"iam.cloud.google.com/injector-version": "dev",
 					}},
 				Spec: corev1.PodSpec{
 					Volumes: []corev1.Volume{
@@ -163,13 +237,2383 @@ func Test_modifyPodSpec(t *testing.T) {
 							},
 						},
 					}}}, true},
+		{"path traversal in annotation",
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "foo",
+					Annotations: map[string]string{
+						"iam.cloud.google.com/service-account": "../../etc",
+					}},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "c1",
+						Image: "i1"}}}},
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "foo",
+					Annotations: map[string]string{
+						"iam.cloud.google.com/service-account": "../../etc",
+					}},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "c1",
+						Image: "i1"}}}}, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := modifyPodSpec(tt.in); got != tt.modified {
+			if got := len(modifyPodSpec(tt.in)) > 0; got != tt.modified {
 				t.Errorf("modifyPodSpec() = %v, want %v", got, tt.modified)
 			}
 			assert.Equal(t, tt.in, tt.want, "wrong injection")
 		})
 	}
 }
+
+func Test_mountPathFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"plain name", "sa-1", "/var/run/secrets/gcp/sa-1", false},
+		{"parent traversal", "../../etc", "", true},
+		{"nested traversal", "a/../../b", "", true},
+		{"root itself", ".", "", true},
+		{"empty", "", "", true},
+		{"absolute path stays under root", "/etc", "/var/run/secrets/gcp/etc", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mountPathFor(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mountPathFor(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("mountPathFor(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_injectEnv(t *testing.T) {
+	defer func(v string) { *envInjectOrder = v }(*envInjectOrder)
+
+	existing := corev1.EnvVar{Name: "FOO", Value: "bar"}
+	injected := corev1.EnvVar{Name: "GOOGLE_APPLICATION_CREDENTIALS", Value: "/key.json"}
+	tests := []struct {
+		order string
+		want  []corev1.EnvVar
+	}{
+		{"append", []corev1.EnvVar{existing, injected}},
+		{"prepend", []corev1.EnvVar{injected, existing}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.order, func(t *testing.T) {
+			*envInjectOrder = tt.order
+			got := injectEnv([]corev1.EnvVar{existing}, injected)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_validateFlags(t *testing.T) {
+	defer func(v string) { *envInjectOrder = v }(*envInjectOrder)
+	defer func(m map[string]string) { cloudSDKEnvValues = m }(cloudSDKEnvValues)
+
+	*envInjectOrder = "prepend"
+	assert.NoError(t, validateFlags())
+	*envInjectOrder = "middle"
+	assert.Error(t, validateFlags())
+	*envInjectOrder = "append"
+
+	defer func(v string) { *cloudSDKEnv = v }(*cloudSDKEnv)
+	*cloudSDKEnv = "CLOUDSDK_CORE_PROJECT=my-project"
+	assert.NoError(t, validateFlags())
+	*cloudSDKEnv = "PROJECT=my-project"
+	assert.Error(t, validateFlags())
+	*cloudSDKEnv = ""
+
+	defer func(a, f string) { *metricsAuth, *metricsTokenFile = a, f }(*metricsAuth, *metricsTokenFile)
+	*metricsAuth = "token"
+	assert.Error(t, validateFlags())
+	*metricsTokenFile = "/var/run/secrets/metrics/token"
+	assert.NoError(t, validateFlags())
+	*metricsAuth = "basic"
+	assert.Error(t, validateFlags())
+}
+
+func Test_namespaceSelected(t *testing.T) {
+	defer func(a, d string) { *namespaceAllowlist, *namespaceDenylist = a, d }(*namespaceAllowlist, *namespaceDenylist)
+	defer func(a, d map[string]bool) { allowedNamespaces, deniedNamespaces = a, d }(allowedNamespaces, deniedNamespaces)
+
+	tests := []struct {
+		name      string
+		allowlist string
+		denylist  string
+		namespace string
+		want      bool
+	}{
+		{"no lists", "", "", "default", true},
+		{"allowed", "team-a,team-b", "", "team-b", true},
+		{"not allowed", "team-a,team-b", "", "default", false},
+		{"denied", "", "kube-system", "kube-system", false},
+		{"not denied", "", "kube-system", "default", true},
+		{"denylist wins", "team-a", "team-a", "team-a", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*namespaceAllowlist, *namespaceDenylist = tt.allowlist, tt.denylist
+			assert.NoError(t, validateFlags())
+			assert.Equal(t, tt.want, namespaceSelected(tt.namespace))
+		})
+	}
+
+	*namespaceAllowlist, *namespaceDenylist = "team-a,,", ""
+	assert.Error(t, validateFlags())
+	*namespaceAllowlist, *namespaceDenylist = "", "Kube_System"
+	assert.Error(t, validateFlags())
+}
+
+func Test_gcpServiceAccountFor(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	indexer.Add(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Name: "annotated", Namespace: "default",
+		Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-ksa"}}})
+	indexer.Add(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Name: "default", Namespace: "default"}})
+
+	defer func(l corelisters.ServiceAccountLister) { serviceAccountLister = l }(serviceAccountLister)
+	serviceAccountLister = corelisters.NewServiceAccountLister(indexer)
+	defer func(v bool) { *watchServiceAccounts = v }(*watchServiceAccounts)
+	*watchServiceAccounts = true
+
+	tests := []struct {
+		name   string
+		in     *corev1.Pod
+		want   string
+		wantOk bool
+	}{
+		{"pod annotation wins",
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default",
+					Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-pod"}},
+				Spec: corev1.PodSpec{ServiceAccountName: "annotated"}},
+			"sa-pod", true},
+		{"annotation from ksa",
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+				Spec:       corev1.PodSpec{ServiceAccountName: "annotated"}},
+			"sa-ksa", true},
+		{"unannotated default ksa",
+			&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}},
+			"", false},
+		{"ksa in other namespace",
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "other"},
+				Spec:       corev1.PodSpec{ServiceAccountName: "annotated"}},
+			"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := gcpServiceAccountFor(tt.in)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("gcpServiceAccountFor() = (%q, %v), want (%q, %v)", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: "annotated",
+			Containers:         []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+	assert.Equal(t, "sa-ksa", pod.Spec.Volumes[0].Secret.SecretName)
+}
+
+func Test_modifyPodSpec_skipWorkloadIdentity(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	indexer.Add(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Name: "wi", Namespace: "default",
+		Annotations: map[string]string{"iam.gke.io/gcp-service-account": "app@my-project.iam.gserviceaccount.com"}}})
+	indexer.Add(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Name: "plain", Namespace: "default"}})
+
+	defer func(l corelisters.ServiceAccountLister) { serviceAccountLister = l }(serviceAccountLister)
+	serviceAccountLister = corelisters.NewServiceAccountLister(indexer)
+	defer func(v bool) { *skipWorkloadIdentity = v }(*skipWorkloadIdentity)
+
+	tests := []struct {
+		name string
+		skip bool
+		ksa  string
+		want bool
+	}{
+		{"workload identity ksa is skipped", true, "wi", false},
+		{"plain ksa is injected", true, "plain", true},
+		{"missing ksa is injected", true, "missing", true},
+		{"check disabled", false, "wi", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*skipWorkloadIdentity = tt.skip
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default",
+					Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: tt.ksa,
+					Containers:         []corev1.Container{{Name: "c1", Image: "i1"}}}}
+			assert.Equal(t, tt.want, len(modifyPodSpec(pod)) > 0)
+			if !tt.want {
+				assert.Empty(t, pod.Spec.Volumes)
+				assert.Empty(t, pod.Spec.Containers[0].Env)
+			}
+		})
+	}
+}
+
+func Test_modifyPodSpec_workloadIdentityMode(t *testing.T) {
+	defer func(v string) { *credentialMode = v }(*credentialMode)
+	*credentialMode = "workload-identity"
+
+	tests := []struct {
+		name    string
+		ksa     string
+		wantKSA string
+	}{
+		{"default ksa is replaced", "", "sa-1"},
+		{"explicit default ksa is replaced", "default", "sa-1"},
+		{"own ksa is kept", "app", "app"},
+		{"missing ksa", "", "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+				cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+			if tt.wantKSA != "default" {
+				indexer.Add(&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+					Name: tt.wantKSA, Namespace: "default"}})
+			}
+			defer func(l corelisters.ServiceAccountLister) { serviceAccountLister = l }(serviceAccountLister)
+			serviceAccountLister = corelisters.NewServiceAccountLister(indexer)
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default",
+					Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: tt.ksa,
+					Containers:         []corev1.Container{{Name: "c1", Image: "i1"}}}}
+			assert.Equal(t, tt.wantKSA == "sa-1", len(modifyPodSpec(pod)) > 0,
+				"only switching the ksa counts as an injection")
+			assert.Equal(t, tt.wantKSA, ksaNameFor(pod))
+			assert.Empty(t, pod.Spec.Volumes, "no secret is mounted")
+			assert.Empty(t, pod.Spec.Containers[0].VolumeMounts)
+			assert.Empty(t, pod.Spec.Containers[0].Env)
+		})
+	}
+
+	*credentialMode = "token"
+	assert.Error(t, validateFlags())
+}
+
+func Test_modifyPodSpec_workloadIdentityToken(t *testing.T) {
+	defer func(v string) { *credentialMode = v }(*credentialMode)
+	*credentialMode = "workload-identity"
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	indexer.Add(&corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "sa-1", Namespace: "default"},
+		Secrets:    []corev1.ObjectReference{{Name: "sa-1-dockercfg-abcde"}, {Name: "sa-1-token-fghij"}}})
+	indexer.Add(&corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "no-token", Namespace: "default"}})
+	defer func(l corelisters.ServiceAccountLister) { serviceAccountLister = l }(serviceAccountLister)
+	serviceAccountLister = corelisters.NewServiceAccountLister(indexer)
+
+	newPod := func(sa string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default",
+				Annotations: map[string]string{"iam.cloud.google.com/service-account": sa}},
+			Spec: corev1.PodSpec{
+				Volumes: []corev1.Volume{{Name: "default-token-12345", VolumeSource: corev1.VolumeSource{
+					Secret: &corev1.SecretVolumeSource{SecretName: "default-token-12345"}}}},
+				Containers: []corev1.Container{{Name: "c1", Image: "i1",
+					VolumeMounts: []corev1.VolumeMount{{Name: "default-token-12345", ReadOnly: true,
+						MountPath: "/var/run/secrets/kubernetes.io/serviceaccount"}}}}}}
+	}
+
+	pod := newPod("sa-1")
+	assert.Equal(t, []string{"sa-1"}, modifyPodSpec(pod))
+	assert.Equal(t, "sa-1", ksaNameFor(pod))
+	assert.Equal(t, "sa-1-token-fghij", pod.Spec.Volumes[0].Secret.SecretName,
+		"the pod gets the API token of its new ksa")
+
+	pod = newPod("no-token")
+	assert.Empty(t, modifyPodSpec(pod))
+	assert.Equal(t, "default", ksaNameFor(pod))
+	assert.Equal(t, "default-token-12345", pod.Spec.Volumes[0].Secret.SecretName)
+}
+
+func Test_namespaceDefaultSecret(t *testing.T) {
+	defer func(m map[string]string) { namespaceDefaultSecrets = m }(namespaceDefaultSecrets)
+	namespaceDefaultSecrets = map[string]string{"team-a": "team-a-sa"}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "team-a"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+	assert.Equal(t, "team-a-sa", pod.Spec.Volumes[0].Secret.SecretName)
+	assert.Equal(t, "/var/run/secrets/gcp/team-a-sa", pod.Spec.Containers[0].VolumeMounts[0].MountPath)
+
+	other := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "team-b"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.Empty(t, modifyPodSpec(other))
+
+	annotated := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "team-a",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "own-sa"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.NotEmpty(t, modifyPodSpec(annotated))
+	assert.Equal(t, "own-sa", annotated.Spec.Volumes[0].Secret.SecretName)
+}
+
+func Test_parseKeyValues(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"", map[string]string{}, false},
+		{"a=b", map[string]string{"a": "b"}, false},
+		{"a=b,c=d", map[string]string{"a": "b", "c": "d"}, false},
+		{"a", nil, true},
+		{"a=", nil, true},
+		{"a=b,a=c", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseKeyValues(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseKeyValues(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_loadClusterConfig(t *testing.T) {
+	inClusterCfg := &rest.Config{Host: "in-cluster"}
+	kubeconfigCfg := &rest.Config{Host: "kubeconfig"}
+	errNoCluster := errors.New("not in cluster")
+
+	tests := []struct {
+		name         string
+		mode         string
+		inClusterErr error
+		want         *rest.Config
+		wantErr      bool
+		wantFallback bool
+	}{
+		{"auto uses in-cluster", "auto", nil, inClusterCfg, false, false},
+		{"auto falls back", "auto", errNoCluster, kubeconfigCfg, false, true},
+		{"in-cluster fails fast", "in-cluster", errNoCluster, nil, true, false},
+		{"in-cluster", "in-cluster", nil, inClusterCfg, false, false},
+		{"kubeconfig skips in-cluster", "kubeconfig", nil, kubeconfigCfg, false, true},
+		{"unknown mode", "bogus", nil, nil, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var usedKubeconfig bool
+			got, err := loadClusterConfig(tt.mode,
+				func() (*rest.Config, error) {
+					if tt.inClusterErr != nil {
+						return nil, tt.inClusterErr
+					}
+					return inClusterCfg, nil
+				},
+				func() (*rest.Config, error) {
+					usedKubeconfig = true
+					return kubeconfigCfg, nil
+				})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadClusterConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantFallback, usedKubeconfig, "kubeconfig loader used")
+		})
+	}
+}
+
+func Test_modifyPodSpec_virtualNode(t *testing.T) {
+	defer func(v []string) { credentialsEnvNames = v }(credentialsEnvNames)
+
+	annotations := map[string]string{"iam.cloud.google.com/service-account": "sa-1"}
+	virtualAffinity := func(values ...string) *corev1.Affinity {
+		return &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+				NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+					MatchExpressions: []corev1.NodeSelectorRequirement{{
+						Key: "type", Operator: corev1.NodeSelectorOpIn, Values: values}}}}}}}
+	}
+	tests := []struct {
+		name     string
+		spec     corev1.PodSpec
+		envNames []string
+		wantEnv  []string
+	}{
+		{"node selector", corev1.PodSpec{
+			NodeSelector: map[string]string{"type": "virtual-kubelet"}},
+			nil, []string{"GOOGLE_APPLICATION_CREDENTIALS_JSON"}},
+		{"node affinity", corev1.PodSpec{
+			Affinity: virtualAffinity("virtual-kubelet")},
+			nil, []string{"GOOGLE_APPLICATION_CREDENTIALS_JSON"}},
+		{"node affinity allowing other nodes", corev1.PodSpec{
+			Affinity: virtualAffinity("virtual-kubelet", "standard")},
+			nil, nil},
+		{"toleration alone", corev1.PodSpec{
+			Tolerations: []corev1.Toleration{{
+				Key: "virtual-kubelet.io/provider", Operator: corev1.TolerationOpExists}}},
+			nil, nil},
+		{"credentials env names", corev1.PodSpec{
+			NodeSelector: map[string]string{"type": "virtual-kubelet"}},
+			[]string{"GCP_KEY", "OTHER_KEY"}, []string{"GCP_KEY_JSON", "OTHER_KEY_JSON"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			credentialsEnvNames = []string{"GOOGLE_APPLICATION_CREDENTIALS"}
+			if tt.envNames != nil {
+				credentialsEnvNames = tt.envNames
+			}
+			tt.spec.Containers = []corev1.Container{{Name: "c1", Image: "i1"}}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Annotations: annotations},
+				Spec:       tt.spec}
+			assert.NotEmpty(t, modifyPodSpec(pod))
+			if tt.wantEnv == nil {
+				assert.Len(t, pod.Spec.Volumes, 1, "key is mounted off Virtual Kubelet nodes")
+				return
+			}
+			assert.Empty(t, pod.Spec.Volumes)
+			assert.Empty(t, pod.Spec.Containers[0].VolumeMounts)
+			var want []corev1.EnvVar
+			for _, name := range tt.wantEnv {
+				want = append(want, corev1.EnvVar{
+					Name: name,
+					ValueFrom: &corev1.EnvVarSource{
+						SecretKeyRef: &corev1.SecretKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "sa-1"},
+							Key:                  "key.json"}}})
+			}
+			assert.Equal(t, want, pod.Spec.Containers[0].Env)
+		})
+	}
+}
+
+func Test_modifyPodSpec_inlineCredentials(t *testing.T) {
+	defer func(v bool) { *inlineCredentials = v }(*inlineCredentials)
+
+	tests := []struct {
+		name       string
+		flag       bool
+		annotation string
+		wantInline bool
+	}{
+		{"default mounts", false, "", false},
+		{"flag", true, "", true},
+		{"annotation", false, "true", true},
+		{"annotation overrides flag", true, "false", false},
+		{"invalid annotation uses flag", true, "yes please", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*inlineCredentials = tt.flag
+			annotations := map[string]string{"iam.cloud.google.com/service-account": "sa-1"}
+			if tt.annotation != "" {
+				annotations["iam.cloud.google.com/inline-credentials"] = tt.annotation
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Annotations: annotations},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+			assert.NotEmpty(t, modifyPodSpec(pod))
+
+			c := pod.Spec.Containers[0]
+			if !tt.wantInline {
+				assert.Len(t, pod.Spec.Volumes, 1)
+				assert.Len(t, c.VolumeMounts, 1)
+				return
+			}
+			assert.Empty(t, pod.Spec.Volumes)
+			assert.Empty(t, c.VolumeMounts)
+			assert.Equal(t, []corev1.EnvVar{{
+				Name: "GOOGLE_APPLICATION_CREDENTIALS_JSON",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "sa-1"},
+						Key:                  "key.json"}}}},
+				c.Env)
+		})
+	}
+}
+
+func Test_modifyPodSpec_multipleServiceAccounts(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-a, sa-b,sa-a"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	inline := pod.DeepCopy()
+	assert.Equal(t, []string{"sa-a", "sa-b"}, modifyPodSpec(pod))
+
+	var volumes []string
+	for _, v := range pod.Spec.Volumes {
+		volumes = append(volumes, v.Name+"="+v.Secret.SecretName)
+	}
+	assert.Equal(t, []string{"gcp-sa-a=sa-a", "gcp-sa-b=sa-b"}, volumes)
+	assert.Equal(t, []corev1.VolumeMount{
+		{Name: "gcp-sa-a", MountPath: "/var/run/secrets/gcp/sa-a", ReadOnly: true},
+		{Name: "gcp-sa-b", MountPath: "/var/run/secrets/gcp/sa-b", ReadOnly: true},
+	}, pod.Spec.Containers[0].VolumeMounts)
+	assert.Equal(t, []corev1.EnvVar{{
+		Name:  "GOOGLE_APPLICATION_CREDENTIALS",
+		Value: "/var/run/secrets/gcp/sa-a/key.json"}}, pod.Spec.Containers[0].Env,
+		"the first account is the default credentials")
+
+	injectedTwice := pod.DeepCopy()
+	assert.NotEmpty(t, modifyPodSpec(injectedTwice))
+	assert.Equal(t, pod.Spec, injectedTwice.Spec, "injecting again changes nothing")
+
+	invalid := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-a,Not_Valid"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.Empty(t, modifyPodSpec(invalid))
+	assert.Empty(t, invalid.Spec.Volumes)
+
+	inline.ObjectMeta.Annotations["iam.cloud.google.com/inline-credentials"] = "true"
+	assert.Equal(t, []string{"sa-a"}, modifyPodSpec(inline),
+		"only the first account can be passed as env")
+}
+
+func Test_modifyPodSpec_maxInjectedVolumes(t *testing.T) {
+	defer func(v int) { *maxInjectedVolumes = v }(*maxInjectedVolumes)
+
+	tests := []struct {
+		name        string
+		max         int
+		wantVolumes []string
+	}{
+		{"no cap", 0, []string{"gcp-sa-a", "gcp-sa-b", "gcp-sa-c"}},
+		{"under cap", 4, []string{"gcp-sa-a", "gcp-sa-b", "gcp-sa-c"}},
+		{"at cap", 3, []string{"gcp-sa-a", "gcp-sa-b", "gcp-sa-c"}},
+		{"over cap", 2, []string{"gcp-sa-a", "gcp-sa-b"}},
+		{"primary only", 1, []string{"gcp-sa-a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*maxInjectedVolumes = tt.max
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo",
+					Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-a,sa-b,sa-c"}},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+
+			var wantNames []string
+			for _, v := range tt.wantVolumes {
+				wantNames = append(wantNames, strings.TrimPrefix(v, "gcp-"))
+			}
+			assert.Equal(t, wantNames, modifyPodSpec(pod))
+			var volumes, mounts []string
+			for _, v := range pod.Spec.Volumes {
+				volumes = append(volumes, v.Name)
+			}
+			for _, m := range pod.Spec.Containers[0].VolumeMounts {
+				mounts = append(mounts, m.Name)
+			}
+			assert.Equal(t, tt.wantVolumes, volumes)
+			assert.Equal(t, tt.wantVolumes, mounts)
+		})
+	}
+}
+
+func Test_modifyPodSpec_secretKeysPerServiceAccount(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{
+				"iam.cloud.google.com/service-account": "sa-a,sa-b",
+				"iam.cloud.google.com/secret-keys":     "sa-a:keyA.json, sa-b:keyB.json"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+
+	items := make(map[string][]corev1.KeyToPath)
+	for _, v := range pod.Spec.Volumes {
+		items[v.Secret.SecretName] = v.Secret.Items
+	}
+	assert.Equal(t, map[string][]corev1.KeyToPath{
+		"sa-a": {{Key: "keyA.json", Path: "keyA.json"}},
+		"sa-b": {{Key: "keyB.json", Path: "keyB.json"}},
+	}, items)
+	assert.Equal(t, "/var/run/secrets/gcp/sa-a/keyA.json", pod.Spec.Containers[0].Env[0].Value)
+
+	for _, invalid := range []string{"sa-a", "sa-a:keyA.json,:keyB.json", "sa-a:../key.json"} {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo",
+				Annotations: map[string]string{
+					"iam.cloud.google.com/service-account": "sa-a,sa-b",
+					"iam.cloud.google.com/secret-keys":     invalid}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+		assert.Empty(t, modifyPodSpec(pod), invalid)
+	}
+}
+
+func Test_modifyPodSpec_disableEnvInjection(t *testing.T) {
+	defer func(v bool) { *disableEnvInjection = v }(*disableEnvInjection)
+	*disableEnvInjection = true
+	defer func(v string) { *cloudSDKEnv = v }(*cloudSDKEnv)
+	*cloudSDKEnv = "CLOUDSDK_CORE_PROJECT=my-project"
+	defer func(m map[string]string) { cloudSDKEnvValues = m }(cloudSDKEnvValues)
+	assert.NoError(t, validateFlags())
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{
+				"iam.cloud.google.com/service-account":    "sa-1",
+				"iam.cloud.google.com/inline-credentials": "true"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+	assert.Len(t, pod.Spec.Volumes, 1)
+	assert.Equal(t, []corev1.VolumeMount{{
+		Name:      "gcp-sa-1",
+		MountPath: "/var/run/secrets/gcp/sa-1",
+		ReadOnly:  true}}, pod.Spec.Containers[0].VolumeMounts)
+	assert.Empty(t, pod.Spec.Containers[0].Env)
+
+	defer func(v bool) { *inlineCredentials = v }(*inlineCredentials)
+	*inlineCredentials = true
+	assert.Error(t, validateFlags())
+}
+
+func Test_modifyPodSpec_initContainers(t *testing.T) {
+	tests := []struct {
+		name       string
+		annotation string
+		writable   bool
+		wantInit   bool
+	}{
+		{"not requested", "", false, false},
+		{"requested", "true", false, true},
+		{"invalid", "sure", false, false},
+		{"requested with writable copy", "true", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			annotations := map[string]string{"iam.cloud.google.com/service-account": "sa-1"}
+			if tt.annotation != "" {
+				annotations["iam.cloud.google.com/inject-init-containers"] = tt.annotation
+			}
+			if tt.writable {
+				annotations["iam.cloud.google.com/writable-copy"] = "true"
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Annotations: annotations},
+				Spec: corev1.PodSpec{
+					InitContainers: []corev1.Container{{Name: "fetch-config", Image: "i0"}},
+					Containers:     []corev1.Container{{Name: "c1", Image: "i1"}}}}
+			assert.NotEmpty(t, modifyPodSpec(pod))
+
+			wantVolumes := 1
+			if tt.writable {
+				wantVolumes = 2
+			}
+			assert.Len(t, pod.Spec.Volumes, wantVolumes)
+			assert.Len(t, pod.Spec.Containers[0].VolumeMounts, 1)
+			assert.Equal(t, []corev1.EnvVar{{
+				Name: "GOOGLE_APPLICATION_CREDENTIALS", Value: "/var/run/secrets/gcp/sa-1/key.json"}},
+				pod.Spec.Containers[0].Env)
+
+			init := pod.Spec.InitContainers[len(pod.Spec.InitContainers)-1]
+			assert.Equal(t, "fetch-config", init.Name)
+			if tt.wantInit {
+				assert.Equal(t, pod.Spec.Containers[0].VolumeMounts, init.VolumeMounts)
+				assert.Equal(t, pod.Spec.Containers[0].Env, init.Env)
+			} else {
+				assert.Empty(t, init.VolumeMounts)
+				assert.Empty(t, init.Env)
+			}
+		})
+	}
+}
+
+func Test_initializePod_failOpen(t *testing.T) {
+	defer func(v bool) { *failOpen = v }(*failOpen)
+	*failOpen = true
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+			Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+				{Name: "serviceaccounts.cloud.google.com"}}}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	clientset := newPatchingClientset(pod)
+
+	var patches int
+	clientset.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches++
+		if patches == 1 {
+			return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "pods"},
+				"foo", errors.New("denied by webhook"))
+		}
+		return false, nil, nil
+	})
+
+	initializePod(pod, clientset)
+
+	assert.Equal(t, 2, patches)
+	got, err := clientset.CoreV1().Pods("default").Get("foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, got.Spec.Volumes, "fallback patch must not inject")
+	assert.False(t, needsInitialization(got))
+}
+
+// newPatchingClientset returns a fake clientset holding objects whose
+// strategic merge patches remove the fields they delete. The fake's own
+// patch reaction decodes the merged object over the stored one, so e.g. the
+// last pending initializer is never removed.
+func newPatchingClientset(objects ...runtime.Object) *fake.Clientset {
+	tracker := k8stesting.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder())
+	for _, obj := range objects {
+		if err := tracker.Add(obj); err != nil {
+			panic(err)
+		}
+	}
+	reaction := k8stesting.ObjectReaction(tracker)
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch, ok := action.(k8stesting.PatchAction)
+		if !ok || patch.GetPatchType() != types.StrategicMergePatchType {
+			return reaction(action)
+		}
+		obj, err := tracker.Get(action.GetResource(), action.GetNamespace(), patch.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+		orig, err := json.Marshal(obj)
+		if err != nil {
+			return true, nil, err
+		}
+		merged, err := strategicpatch.StrategicMergePatch(orig, patch.GetPatch(), obj)
+		if err != nil {
+			return true, nil, err
+		}
+		patched := reflect.New(reflect.TypeOf(obj).Elem()).Interface().(runtime.Object)
+		if err := json.Unmarshal(merged, patched); err != nil {
+			return true, nil, err
+		}
+		return true, patched, tracker.Update(action.GetResource(), patched, action.GetNamespace())
+	})
+	return clientset
+}
+
+func Test_raiseTerminationGracePeriod(t *testing.T) {
+	seconds := func(v int64) *int64 { return &v }
+	tests := []struct {
+		name string
+		in   *int64
+		min  int64
+		want *int64
+	}{
+		{"disabled", seconds(10), 0, seconds(10)},
+		{"below min is raised", seconds(10), 60, seconds(60)},
+		{"equal to min is kept", seconds(60), 60, seconds(60)},
+		{"above min is kept", seconds(120), 60, seconds(120)},
+		{"unset is raised", nil, 60, seconds(60)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &corev1.PodSpec{TerminationGracePeriodSeconds: tt.in}
+			raiseTerminationGracePeriod(spec, tt.min)
+			assert.Equal(t, tt.want, spec.TerminationGracePeriodSeconds)
+		})
+	}
+}
+
+func Test_removeStaleInitializers(t *testing.T) {
+	now := time.Date(2017, 11, 1, 12, 0, 0, 0, time.UTC)
+	pendingPod := func(name string, age time.Duration) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name: name, Namespace: "default",
+			CreationTimestamp: metav1.NewTime(now.Add(-age)),
+			Annotations:       map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+			Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+				{Name: "serviceaccounts.cloud.google.com"}}}}}
+	}
+	defer func(v int) { *maxPendingInitializers = v }(*maxPendingInitializers)
+	*maxPendingInitializers = 1
+	overLimit := pendingPod("over-limit", 2*time.Hour)
+	overLimit.Initializers.Pending = append(overLimit.Initializers.Pending, metav1.Initializer{Name: "other"})
+	clientset := newPatchingClientset(
+		pendingPod("stale", 2*time.Hour),
+		pendingPod("fresh", time.Minute),
+		overLimit)
+
+	n, err := removeStaleInitializers(clientset, time.Hour, now)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	got, err := clientset.CoreV1().Pods("default").Get("over-limit", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []metav1.Initializer{{Name: "other"}}, got.GetInitializers().Pending,
+		"pods over -max-pending-initializers are unblocked too")
+
+	stale, err := clientset.CoreV1().Pods("default").Get("stale", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.False(t, needsInitialization(stale))
+	assert.Empty(t, stale.Spec.Volumes, "stale pods are unblocked without injection")
+
+	fresh, err := clientset.CoreV1().Pods("default").Get("fresh", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.True(t, needsInitialization(fresh))
+}
+
+func Test_modifyPodSpec_perContainerEnvName(t *testing.T) {
+	defer func(v bool) { *injectAllContainers = v }(*injectAllContainers)
+	*injectAllContainers = true
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{
+				"iam.cloud.google.com/service-account": "sa-1",
+				"iam.cloud.google.com/env.app":         "GOOGLE_APPLICATION_CREDENTIALS",
+				"iam.cloud.google.com/env.worker":      "GCP_KEY",
+				"iam.cloud.google.com/env.bad":         "1-NOT-VALID",
+			}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "app", Image: "i1"},
+			{Name: "worker", Image: "i2"},
+			{Name: "bad", Image: "i3"},
+			{Name: "other", Image: "i4"},
+		}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+
+	want := map[string]string{
+		"app":    "GOOGLE_APPLICATION_CREDENTIALS",
+		"worker": "GCP_KEY",
+		"bad":    "GOOGLE_APPLICATION_CREDENTIALS",
+		"other":  "GOOGLE_APPLICATION_CREDENTIALS",
+	}
+	for _, c := range pod.Spec.Containers {
+		assert.Equal(t, []corev1.EnvVar{{
+			Name:  want[c.Name],
+			Value: "/var/run/secrets/gcp/sa-1/key.json"}}, c.Env, c.Name)
+	}
+}
+
+func Test_unknownAnnotations(t *testing.T) {
+	tests := []struct {
+		name string
+		in   map[string]string
+		want []string
+	}{
+		{"nil", nil, nil},
+		{"known only", map[string]string{
+			"iam.cloud.google.com/service-account": "sa-1",
+			"iam.cloud.google.com/env.app":         "GCP_KEY",
+			"example.com/other":                    "x"}, nil},
+		{"typo", map[string]string{
+			"iam.cloud.google.com/servie-account": "sa-1"},
+			[]string{"iam.cloud.google.com/servie-account"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, unknownAnnotations(tt.in))
+		})
+	}
+}
+
+func Test_modifyPodSpec_strictAnnotations(t *testing.T) {
+	defer func(v bool) { *strictAnnotations = v }(*strictAnnotations)
+	newPod := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo",
+				Annotations: map[string]string{
+					"iam.cloud.google.com/service-account": "sa-1",
+					"iam.cloud.google.com/servie-acount":   "sa-2",
+				}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	}
+
+	*strictAnnotations = false
+	assert.NotEmpty(t, modifyPodSpec(newPod()), "typo only warns by default")
+
+	*strictAnnotations = true
+	pod := newPod()
+	assert.Empty(t, modifyPodSpec(pod), "typo skips injection in strict mode")
+	assert.Empty(t, pod.Spec.Volumes)
+}
+
+func Test_modifyPodSpec_preservesScheduling(t *testing.T) {
+	affinity := &corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+				NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+					MatchExpressions: []corev1.NodeSelectorRequirement{{
+						Key:      "cloud.google.com/gke-accelerator",
+						Operator: corev1.NodeSelectorOpIn,
+						Values:   []string{"nvidia-tesla-p100", "nvidia-tesla-k80"},
+					}}}}},
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.PreferredSchedulingTerm{{
+				Weight: 10,
+				Preference: corev1.NodeSelectorTerm{
+					MatchExpressions: []corev1.NodeSelectorRequirement{{
+						Key:      "cloud.google.com/gke-preemptible",
+						Operator: corev1.NodeSelectorOpDoesNotExist,
+					}}}}}},
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{{
+				LabelSelector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"app": "trainer"}},
+				TopologyKey: "kubernetes.io/hostname",
+			}}},
+	}
+	nodeSelector := map[string]string{"cloud.google.com/gke-nodepool": "gpu-pool"}
+	tolerations := []corev1.Toleration{{
+		Key:      "nvidia.com/gpu",
+		Operator: corev1.TolerationOpExists,
+		Effect:   corev1.TaintEffectNoSchedule,
+	}}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: corev1.PodSpec{
+			Affinity:     affinity.DeepCopy(),
+			NodeSelector: map[string]string{"cloud.google.com/gke-nodepool": "gpu-pool"},
+			Tolerations:  append([]corev1.Toleration(nil), tolerations...),
+			Containers:   []corev1.Container{{Name: "c1", Image: "i1"}}}}
+
+	assert.NotEmpty(t, modifyPodSpec(pod))
+	assert.Len(t, pod.Spec.Volumes, 1)
+	assert.Equal(t, affinity, pod.Spec.Affinity)
+	assert.Equal(t, nodeSelector, pod.Spec.NodeSelector)
+	assert.Equal(t, tolerations, pod.Spec.Tolerations)
+}
+
+func Test_modifyPodSpec_cloudSDKEnv(t *testing.T) {
+	defer func(v bool) { *injectAllContainers = v }(*injectAllContainers)
+	*injectAllContainers = true
+	defer func(m map[string]string) { cloudSDKEnvValues = m }(cloudSDKEnvValues)
+	cloudSDKEnvValues = map[string]string{
+		"CLOUDSDK_CORE_PROJECT": "my-project",
+		"CLOUDSDK_COMPUTE_ZONE": "us-central1-b",
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "c1", Image: "i1"},
+			{Name: "c2", Image: "i2", Env: []corev1.EnvVar{
+				{Name: "CLOUDSDK_CORE_PROJECT", Value: "own-project"}}},
+		}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+
+	assert.Equal(t, []corev1.EnvVar{
+		{Name: "GOOGLE_APPLICATION_CREDENTIALS", Value: "/var/run/secrets/gcp/sa-1/key.json"},
+		{Name: "CLOUDSDK_COMPUTE_ZONE", Value: "us-central1-b"},
+		{Name: "CLOUDSDK_CORE_PROJECT", Value: "my-project"},
+	}, pod.Spec.Containers[0].Env)
+	assert.Equal(t, []corev1.EnvVar{
+		{Name: "CLOUDSDK_CORE_PROJECT", Value: "own-project"},
+		{Name: "GOOGLE_APPLICATION_CREDENTIALS", Value: "/var/run/secrets/gcp/sa-1/key.json"},
+		{Name: "CLOUDSDK_COMPUTE_ZONE", Value: "us-central1-b"},
+	}, pod.Spec.Containers[1].Env, "existing CLOUDSDK_* vars are not duplicated")
+}
+
+func Test_modifyPodSpec_injectToggle(t *testing.T) {
+	tests := []struct {
+		value    string
+		modified bool
+	}{
+		{"true", true},
+		{"false", false},
+		{"not-a-bool", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo",
+					Annotations: map[string]string{
+						"iam.cloud.google.com/service-account": "sa-1",
+						"iam.cloud.google.com/inject":          tt.value,
+					}},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+			assert.Equal(t, tt.modified, len(modifyPodSpec(pod)) > 0)
+			assert.Equal(t, tt.modified, len(pod.Spec.Volumes) == 1)
+		})
+	}
+}
+
+func Test_modifyPodSpec_defaultMountSubdir(t *testing.T) {
+	defer func(v string) { *defaultMountSubdir = v }(*defaultMountSubdir)
+	*defaultMountSubdir = "sa"
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+	assert.Equal(t, "/var/run/secrets/gcp/sa/sa-1", pod.Spec.Containers[0].VolumeMounts[0].MountPath)
+	assert.Equal(t, "/var/run/secrets/gcp/sa/sa-1/key.json", pod.Spec.Containers[0].Env[0].Value)
+
+	_, err := mountPathFor("../other")
+	assert.Error(t, err, "traversal out of the subdir is rejected")
+
+	for _, bad := range []string{"/abs", "..", "../x", "."} {
+		*defaultMountSubdir = bad
+		assert.Error(t, validateFlags(), bad)
+	}
+}
+
+func Test_patchPod_events(t *testing.T) {
+	defer func(v bool) { *patchEvents = v }(*patchEvents)
+	defer func(r record.EventRecorder) { recorder = r }(recorder)
+	*patchEvents = true
+	fakeRecorder := record.NewFakeRecorder(1)
+	recorder = fakeRecorder
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	modifiedPod := pod.DeepCopy()
+	for i := 0; i < 50; i++ {
+		modifiedPod.Spec.Containers = append(modifiedPod.Spec.Containers,
+			corev1.Container{Name: fmt.Sprintf("sidecar-%d", i), Image: "i2"})
+	}
+	modifyPodSpec(modifiedPod)
+
+	assert.NoError(t, patchPod(pod, modifiedPod, fake.NewSimpleClientset(pod)))
+
+	event := <-fakeRecorder.Events
+	assert.True(t, strings.HasPrefix(event, "Normal Patched Applied patch: {"), event)
+	assert.True(t, strings.HasSuffix(event, "...(truncated)"), event)
+	assert.True(t, len(event) < 1100, "event message length %d", len(event))
+}
+
+func Test_truncate(t *testing.T) {
+	assert.Equal(t, "short", truncate("short", 10))
+	assert.Equal(t, "exactly10!", truncate("exactly10!", 10))
+	assert.Equal(t, "abcdef...(truncated)", truncate("abcdefghijklmnopqrstuvwxyz", 20))
+}
+
+func Test_modifyPodSpec_hostNetwork(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: corev1.PodSpec{
+			HostNetwork: true,
+			DNSPolicy:   corev1.DNSClusterFirstWithHostNet,
+			Containers: []corev1.Container{{
+				Name:  "c1",
+				Image: "i1",
+				Ports: []corev1.ContainerPort{{ContainerPort: 8080, HostPort: 8080}}}}}}
+
+	assert.NotEmpty(t, modifyPodSpec(pod))
+	assert.True(t, pod.Spec.HostNetwork)
+	assert.Equal(t, corev1.DNSClusterFirstWithHostNet, pod.Spec.DNSPolicy)
+	assert.Equal(t, []corev1.ContainerPort{{ContainerPort: 8080, HostPort: 8080}},
+		pod.Spec.Containers[0].Ports)
+	assert.Len(t, pod.Spec.Volumes, 1)
+	assert.Equal(t, []corev1.VolumeMount{{
+		Name:      "gcp-sa-1",
+		ReadOnly:  true,
+		MountPath: "/var/run/secrets/gcp/sa-1"}}, pod.Spec.Containers[0].VolumeMounts)
+	assert.Equal(t, []corev1.EnvVar{{
+		Name:  "GOOGLE_APPLICATION_CREDENTIALS",
+		Value: "/var/run/secrets/gcp/sa-1/key.json"}}, pod.Spec.Containers[0].Env)
+}
+
+func Test_shardFor(t *testing.T) {
+	for _, uid := range []types.UID{"", "a", "5b1fcd2e-c2a1-11e7-8f1a-42010a800002"} {
+		for total := 1; total <= 5; total++ {
+			got := shardFor(uid, total)
+			assert.True(t, got >= 0 && got < total, "shardFor(%q, %d) = %d", uid, total, got)
+			assert.Equal(t, got, shardFor(uid, total), "shardFor must be stable")
+		}
+	}
+}
+
+func Test_initializePod_sharding(t *testing.T) {
+	defer func(s, n int) { *shard, *totalShards = s, n }(*shard, *totalShards)
+	*totalShards = 3
+
+	newPod := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default", UID: "uid-1",
+				Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+				Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+					{Name: "serviceaccounts.cloud.google.com"}}}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	}
+
+	var owners int
+	for i := 0; i < *totalShards; i++ {
+		*shard = i
+		pod := newPod()
+		clientset := newPatchingClientset(pod)
+		initializePod(pod, clientset)
+
+		got, err := clientset.CoreV1().Pods("default").Get("foo", metav1.GetOptions{})
+		assert.NoError(t, err)
+		if i == shardFor("uid-1", *totalShards) {
+			owners++
+			assert.False(t, needsInitialization(got), "owning shard %d initializes the pod", i)
+		} else {
+			assert.True(t, needsInitialization(got), "shard %d must skip the pod", i)
+		}
+	}
+	assert.Equal(t, 1, owners)
+}
+
+func Test_modifyPodSpec_targetContainerPort(t *testing.T) {
+	defer func(v int) { *targetContainerPort = v }(*targetContainerPort)
+	*targetContainerPort = 8080
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "proxy", Image: "i1", Ports: []corev1.ContainerPort{{ContainerPort: 15001}}},
+			{Name: "app", Image: "i2", Ports: []corev1.ContainerPort{
+				{ContainerPort: 9090}, {ContainerPort: 8080}}},
+			{Name: "logger", Image: "i3"},
+		}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+	assert.Len(t, pod.Spec.Volumes, 1)
+	for _, c := range pod.Spec.Containers {
+		if c.Name == "app" {
+			assert.Len(t, c.VolumeMounts, 1, c.Name)
+			assert.Len(t, c.Env, 1, c.Name)
+		} else {
+			assert.Empty(t, c.VolumeMounts, c.Name)
+			assert.Empty(t, c.Env, c.Name)
+		}
+	}
+
+	*targetContainerPort = 443
+	unmatched := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.Empty(t, modifyPodSpec(unmatched))
+	assert.Empty(t, unmatched.Spec.Volumes)
+}
+
+func Test_initializePod_statusCondition(t *testing.T) {
+	defer func(v bool) { *statusCondition = v }(*statusCondition)
+	*statusCondition = true
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+			Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+				{Name: "serviceaccounts.cloud.google.com"}}}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}},
+		Status: corev1.PodStatus{Conditions: []corev1.PodCondition{{
+			Type: corev1.PodScheduled, Status: corev1.ConditionFalse}}}}
+	clientset := fake.NewSimpleClientset(pod)
+
+	initializePod(pod, clientset)
+
+	var statusPatched bool
+	for _, a := range clientset.Actions() {
+		if a.GetVerb() == "patch" && a.GetSubresource() == "status" {
+			statusPatched = true
+		}
+	}
+	assert.True(t, statusPatched, "status subresource patched")
+
+	got, err := clientset.CoreV1().Pods("default").Get("foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, got.Status.Conditions, 2)
+	var cond *corev1.PodCondition
+	for i := range got.Status.Conditions {
+		if got.Status.Conditions[i].Type == "InjectionApplied" {
+			cond = &got.Status.Conditions[i]
+		}
+	}
+	if assert.NotNil(t, cond) {
+		assert.Equal(t, corev1.ConditionTrue, cond.Status)
+		assert.Equal(t, "CredentialsInjected", cond.Reason)
+	}
+}
+
+func Test_setPodCondition(t *testing.T) {
+	status := &corev1.PodStatus{}
+	setPodCondition(status, corev1.PodCondition{Type: "InjectionApplied", Status: corev1.ConditionFalse})
+	setPodCondition(status, corev1.PodCondition{Type: "InjectionApplied", Status: corev1.ConditionTrue})
+	assert.Equal(t, []corev1.PodCondition{{Type: "InjectionApplied", Status: corev1.ConditionTrue}},
+		status.Conditions)
+}
+
+func Test_modifyPodSpec_versionAnnotation(t *testing.T) {
+	defer func(v string) { version = v }(version)
+	version = "v1.2.3"
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+	assert.Equal(t, "v1.2.3", pod.ObjectMeta.Annotations["iam.cloud.google.com/injector-version"])
+	assert.Empty(t, unknownAnnotations(pod.ObjectMeta.Annotations))
+
+	skipped := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}}
+	assert.Empty(t, modifyPodSpec(skipped))
+	assert.Nil(t, skipped.ObjectMeta.Annotations, "pods that are not injected are not annotated")
+}
+
+func Test_volumeNameFor(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      *corev1.Pod
+		sa      string
+		want    string
+		wantErr bool
+	}{
+		{"derived name",
+			&corev1.Pod{},
+			"sa-1", "gcp-sa-1", false},
+		{"invalid derived name",
+			&corev1.Pod{},
+			"sa.v1", "", true},
+		{"custom name",
+			&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+				"iam.cloud.google.com/volume-name": "creds"}}},
+			"sa-1", "creds", false},
+		{"invalid name",
+			&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+				"iam.cloud.google.com/volume-name": "Not_A_Label"}}},
+			"sa-1", "", true},
+		{"colliding name",
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+					"iam.cloud.google.com/volume-name": "data"}},
+				Spec: corev1.PodSpec{Volumes: []corev1.Volume{{Name: "data"}}}},
+			"sa-1", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := volumeNameFor(tt.in, tt.sa)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("volumeNameFor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_modifyPodSpec_customVolumeName(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{
+				"iam.cloud.google.com/service-account": "sa-1",
+				"iam.cloud.google.com/volume-name":     "creds",
+			}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+	assert.Equal(t, "creds", pod.Spec.Volumes[0].Name)
+	assert.Equal(t, "creds", pod.Spec.Containers[0].VolumeMounts[0].Name)
+
+	colliding := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{
+				"iam.cloud.google.com/service-account": "sa-1",
+				"iam.cloud.google.com/volume-name":     "data",
+			}},
+		Spec: corev1.PodSpec{
+			Volumes:    []corev1.Volume{{Name: "data"}},
+			Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.Empty(t, modifyPodSpec(colliding))
+	assert.Len(t, colliding.Spec.Volumes, 1)
+}
+
+func Test_modifyPodSpec_targetImageSubstring(t *testing.T) {
+	defer func(v string) { *targetImageSubstring = v }(*targetImageSubstring)
+	*targetImageSubstring = "gcr.io/my-project/app"
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo-7d9f8",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "sidecar-x1", Image: "gcr.io/istio-release/proxyv2:1.0.0"},
+			{Name: "main-a8f2", Image: "gcr.io/my-project/app:v42"},
+		}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+	assert.Empty(t, pod.Spec.Containers[0].VolumeMounts)
+	assert.Empty(t, pod.Spec.Containers[0].Env)
+	assert.Len(t, pod.Spec.Containers[1].VolumeMounts, 1)
+	assert.Len(t, pod.Spec.Containers[1].Env, 1)
+}
+
+func Test_modifyPodSpec_mountPropagation(t *testing.T) {
+	tests := []struct {
+		value    string
+		modified bool
+		want     *corev1.MountPropagationMode
+	}{
+		{"None", true, func() *corev1.MountPropagationMode {
+			m := corev1.MountPropagationNone
+			return &m
+		}()},
+		{"HostToContainer", true, func() *corev1.MountPropagationMode {
+			m := corev1.MountPropagationHostToContainer
+			return &m
+		}()},
+		{"Sideways", false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo",
+					Annotations: map[string]string{
+						"iam.cloud.google.com/service-account":   "sa-1",
+						"iam.cloud.google.com/mount-propagation": tt.value,
+					}},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+			assert.Equal(t, tt.modified, len(modifyPodSpec(pod)) > 0)
+			if !tt.modified {
+				assert.Empty(t, pod.Spec.Containers[0].VolumeMounts)
+				return
+			}
+			assert.Equal(t, tt.want, pod.Spec.Containers[0].VolumeMounts[0].MountPropagation)
+		})
+	}
+}
+
+func Test_modifyPodSpec_denyPrivileged(t *testing.T) {
+	defer func(v bool) { *denyPrivileged = v }(*denyPrivileged)
+	privileged, unprivileged := true, false
+	newPod := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo",
+				Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{
+				{Name: "agent", Image: "i1",
+					SecurityContext: &corev1.SecurityContext{Privileged: &privileged}},
+				{Name: "app", Image: "i2",
+					SecurityContext: &corev1.SecurityContext{Privileged: &unprivileged}},
+			}}}
+	}
+
+	*denyPrivileged = false
+	pod := newPod()
+	assert.NotEmpty(t, modifyPodSpec(pod))
+	assert.Len(t, pod.Spec.Containers[0].VolumeMounts, 1, "privileged allowed by default")
+
+	*denyPrivileged = true
+	pod = newPod()
+	assert.NotEmpty(t, modifyPodSpec(pod))
+	assert.Empty(t, pod.Spec.Containers[0].VolumeMounts)
+	assert.Empty(t, pod.Spec.Containers[0].Env)
+	assert.Len(t, pod.Spec.Containers[1].VolumeMounts, 1)
+	assert.Len(t, pod.Spec.Containers[1].Env, 1)
+}
+
+func Test_topologyEnvVars(t *testing.T) {
+	defer func(v bool) { *injectTopologyEnv = v }(*injectTopologyEnv)
+	defer func(l corelisters.NodeLister) { nodeLister = l }(nodeLister)
+	*injectTopologyEnv = true
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	indexer.Add(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1",
+		Labels: map[string]string{
+			"topology.kubernetes.io/region": "us-central1",
+			"topology.kubernetes.io/zone":   "us-central1-b"}}})
+	indexer.Add(&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-2",
+		Labels: map[string]string{
+			"failure-domain.beta.kubernetes.io/region": "europe-west1",
+			"failure-domain.beta.kubernetes.io/zone":   "europe-west1-d"}}})
+	nodeLister = corelisters.NewNodeLister(indexer)
+
+	tests := []struct {
+		name string
+		spec corev1.PodSpec
+		want []corev1.EnvVar
+	}{
+		{"bound to node", corev1.PodSpec{NodeName: "node-1"}, []corev1.EnvVar{
+			{Name: "GCP_REGION", Value: "us-central1"},
+			{Name: "GCP_ZONE", Value: "us-central1-b"}}},
+		{"deprecated labels", corev1.PodSpec{NodeName: "node-2"}, []corev1.EnvVar{
+			{Name: "GCP_REGION", Value: "europe-west1"},
+			{Name: "GCP_ZONE", Value: "europe-west1-d"}}},
+		{"pinned by node selector", corev1.PodSpec{NodeSelector: map[string]string{
+			"topology.kubernetes.io/zone": "asia-east1-a"}}, []corev1.EnvVar{
+			{Name: "GCP_ZONE", Value: "asia-east1-a"}}},
+		{"unscheduled", corev1.PodSpec{}, nil},
+		{"unknown node", corev1.PodSpec{NodeName: "gone"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo"}, Spec: tt.spec}
+			assert.Equal(t, tt.want, topologyEnvVars(pod))
+		})
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: corev1.PodSpec{
+			NodeName:   "node-1",
+			Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+	assert.Equal(t, []corev1.EnvVar{
+		{Name: "GOOGLE_APPLICATION_CREDENTIALS", Value: "/var/run/secrets/gcp/sa-1/key.json"},
+		{Name: "GCP_REGION", Value: "us-central1"},
+		{Name: "GCP_ZONE", Value: "us-central1-b"}}, pod.Spec.Containers[0].Env)
+}
+
+func Test_createPodPatch_annotationOnly(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default",
+			Labels:      map[string]string{"app": "web"},
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	modifiedPod := pod.DeepCopy()
+	modifiedPod.ObjectMeta.Annotations["iam.cloud.google.com/injector-version"] = "v2"
+
+	patch, err := createPodPatch(pod, modifiedPod)
+	assert.NoError(t, err)
+	assert.JSONEq(t,
+		`{"metadata":{"annotations":{"iam.cloud.google.com/injector-version":"v2"}}}`,
+		string(patch))
+}
+
+func Test_modifyPodSpec_reuseExistingVolume(t *testing.T) {
+	tests := []struct {
+		name       string
+		volume     corev1.Volume
+		wantVolume string
+		wantCount  int
+	}{
+		{"whole secret", corev1.Volume{Name: "my-creds", VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: "sa-1"}}},
+			"my-creds", 1},
+		{"matching item", corev1.Volume{Name: "my-creds", VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: "sa-1",
+				Items: []corev1.KeyToPath{{Key: "key.json", Path: "key.json"}}}}},
+			"my-creds", 1},
+		{"key remapped", corev1.Volume{Name: "my-creds", VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: "sa-1",
+				Items: []corev1.KeyToPath{{Key: "key.json", Path: "creds.json"}}}}},
+			"gcp-sa-1", 2},
+		{"other secret", corev1.Volume{Name: "my-creds", VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{SecretName: "sa-2"}}},
+			"gcp-sa-1", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo",
+					Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+				Spec: corev1.PodSpec{
+					Volumes:    []corev1.Volume{tt.volume},
+					Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+			assert.NotEmpty(t, modifyPodSpec(pod))
+			assert.Len(t, pod.Spec.Volumes, tt.wantCount)
+			assert.Equal(t, tt.wantVolume, pod.Spec.Containers[0].VolumeMounts[0].Name)
+			assert.Equal(t, "/var/run/secrets/gcp/sa-1", pod.Spec.Containers[0].VolumeMounts[0].MountPath)
+		})
+	}
+}
+
+func Test_modifyPodSpec_annotationValidation(t *testing.T) {
+	defer func(v int) { *maxAnnotationLength = v }(*maxAnnotationLength)
+	newPod := func(sa string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo",
+				Annotations: map[string]string{"iam.cloud.google.com/service-account": sa}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	}
+
+	oversized := newPod(strings.Repeat("a", 300))
+	assert.Empty(t, modifyPodSpec(oversized))
+	assert.Empty(t, oversized.Spec.Volumes)
+
+	*maxAnnotationLength = 4
+	assert.Empty(t, modifyPodSpec(newPod("sa-12")), "value over configured max")
+	assert.NotEmpty(t, modifyPodSpec(newPod("sa-1")))
+
+	*maxAnnotationLength = 253
+	assert.Empty(t, modifyPodSpec(newPod("Not/A$Secret")), "invalid characters")
+}
+
+func Test_modifyPodSpec_envFromSecret(t *testing.T) {
+	defer func(v bool) { *injectAllContainers = v }(*injectAllContainers)
+	*injectAllContainers = true
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: corev1.PodSpec{
+			NodeSelector: map[string]string{"type": "virtual-kubelet"},
+			Containers: []corev1.Container{
+				{Name: "c1", Image: "i1", EnvFrom: []corev1.EnvFromSource{{
+					SecretRef: &corev1.SecretEnvSource{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "sa-1"}}}}},
+				{Name: "c2", Image: "i2", EnvFrom: []corev1.EnvFromSource{{
+					SecretRef: &corev1.SecretEnvSource{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "other"}}}}},
+			}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+	for _, c := range pod.Spec.Containers {
+		if assert.Len(t, c.Env, 1, "envFrom does not expose the key.json key") {
+			assert.Equal(t, "GOOGLE_APPLICATION_CREDENTIALS_JSON", c.Env[0].Name)
+			assert.Equal(t, "sa-1", c.Env[0].ValueFrom.SecretKeyRef.Name)
+		}
+	}
+}
+
+func Test_modifyPodSpec_expiryMonitor(t *testing.T) {
+	defer func(v string) { *expiryMonitorImage = v }(*expiryMonitorImage)
+	*expiryMonitorImage = "gcr.io/example/key-expiry:v1"
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+	assert.Len(t, pod.Spec.Containers, 2)
+	assert.Equal(t, "true", pod.Labels["iam.cloud.google.com/expiry-monitor"])
+
+	sidecar := pod.Spec.Containers[1]
+	assert.Equal(t, "credential-expiry-monitor", sidecar.Name)
+	assert.Equal(t, "gcr.io/example/key-expiry:v1", sidecar.Image)
+	assert.Equal(t, []corev1.VolumeMount{{
+		Name:      "gcp-sa-1",
+		MountPath: "/var/run/secrets/gcp/sa-1",
+		ReadOnly:  true}}, sidecar.VolumeMounts)
+	assert.Equal(t, []corev1.EnvVar{{
+		Name:  "GOOGLE_APPLICATION_CREDENTIALS",
+		Value: "/var/run/secrets/gcp/sa-1/key.json"}}, sidecar.Env)
+
+	for _, policy := range []corev1.RestartPolicy{corev1.RestartPolicyNever, corev1.RestartPolicyOnFailure} {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo",
+				Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+			Spec: corev1.PodSpec{
+				RestartPolicy: policy,
+				Containers:    []corev1.Container{{Name: "c1", Image: "i1"}}}}
+		assert.NotEmpty(t, modifyPodSpec(pod))
+		assert.Len(t, pod.Spec.Containers, 1, "no sidecar with restartPolicy %s", policy)
+	}
+}
+
+func Test_modifyPodSpec_requireSecretLabel(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	indexer.Add(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name: "labeled", Namespace: "default",
+		Labels: map[string]string{"iam.cloud.google.com/mountable": "true"}}})
+	indexer.Add(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name: "unlabeled", Namespace: "default"}})
+
+	defer func(l corelisters.SecretLister) { secretLister = l }(secretLister)
+	secretLister = corelisters.NewSecretLister(indexer)
+	defer func(v string) { *requireSecretLabel = v }(*requireSecretLabel)
+	*requireSecretLabel = "iam.cloud.google.com/mountable=true"
+	defer func(s labels.Selector) { requiredSecretSelector = s }(requiredSecretSelector)
+	assert.NoError(t, validateFlags())
+
+	tests := []struct {
+		secret string
+		want   bool
+	}{
+		{"labeled", true},
+		{"unlabeled", false},
+		{"missing", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.secret, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default",
+					Annotations: map[string]string{"iam.cloud.google.com/service-account": tt.secret}},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+			assert.Equal(t, tt.want, len(modifyPodSpec(pod)) > 0)
+		})
+	}
+}
+
+func Test_gcpServiceAccountFor_secretFallback(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	indexer.Add(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "team-default", Namespace: "default"}})
+	indexer.Add(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "per-pod", Namespace: "default"}})
+
+	defer func(l corelisters.SecretLister) { secretLister = l }(secretLister)
+	secretLister = corelisters.NewSecretLister(indexer)
+	defer func(v bool) { *secretFallback = v }(*secretFallback)
+	defer func(m map[string]string) { namespaceDefaultSecrets = m }(namespaceDefaultSecrets)
+	namespaceDefaultSecrets = map[string]string{"default": "team-default"}
+
+	tests := []struct {
+		name       string
+		fallback   bool
+		annotation string
+		want       string
+	}{
+		{"annotation exists", true, "per-pod", "per-pod"},
+		{"annotation missing falls back to default", true, "missing", "team-default"},
+		{"no annotation", true, "", "team-default"},
+		{"fallback disabled", false, "missing", "missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*secretFallback = tt.fallback
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"}}
+			if tt.annotation != "" {
+				pod.ObjectMeta.Annotations = map[string]string{
+					"iam.cloud.google.com/service-account": tt.annotation}
+			}
+			got, ok := gcpServiceAccountFor(pod)
+			assert.True(t, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	*secretFallback = true
+	namespaceDefaultSecrets = map[string]string{"default": "also-missing"}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default",
+		Annotations: map[string]string{"iam.cloud.google.com/service-account": "missing"}}}
+	got, ok := gcpServiceAccountFor(pod)
+	assert.True(t, ok)
+	assert.Equal(t, "missing", got, "the first candidate is used if none exists")
+}
+
+func Test_initializePod_doesNotMutateCachedPod(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+			Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+				{Name: "serviceaccounts.cloud.google.com"}, {Name: "other"}}}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	orig := pod.DeepCopy()
+	clientset := fake.NewSimpleClientset(pod)
+
+	initializePod(pod, clientset)
+
+	assert.Equal(t, orig, pod, "the informer's copy of the pod must not be modified")
+	got, err := clientset.CoreV1().Pods("default").Get("foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, got.Spec.Volumes, 1)
+}
+
+func Benchmark_modifyPodSpec(b *testing.B) {
+	defer func(v bool) { *injectAllContainers = v }(*injectAllContainers)
+	*injectAllContainers = true
+
+	containers := make([]corev1.Container, 50)
+	for i := range containers {
+		containers[i] = corev1.Container{Name: fmt.Sprintf("c%d", i), Image: "i"}
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo",
+				Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+			Spec: corev1.PodSpec{
+				Containers: append([]corev1.Container(nil), containers...)}}
+		if len(modifyPodSpec(pod)) == 0 {
+			b.Fatal("pod was not injected")
+		}
+	}
+}
+
+func Test_modifyPodSpec_singleVolumeForManyContainers(t *testing.T) {
+	defer func(v bool) { *injectAllContainers = v }(*injectAllContainers)
+	*injectAllContainers = true
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "c1", Image: "i1"},
+				{Name: "c2", Image: "i2"},
+				{Name: "c3", Image: "i3"}}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+	assert.Len(t, pod.Spec.Volumes, 1)
+	for _, c := range pod.Spec.Containers {
+		assert.Equal(t, []corev1.VolumeMount{{
+			Name:      "gcp-sa-1",
+			MountPath: "/var/run/secrets/gcp/sa-1",
+			ReadOnly:  true}}, c.VolumeMounts, "container %s", c.Name)
+	}
+}
+
+func Test_modifyPodSpec_removeEnv(t *testing.T) {
+	defer func(v string) { *removeEnv = v }(*removeEnv)
+	defer func(m map[string]bool) { removeEnvNames = m }(removeEnvNames)
+	*removeEnv = "GOOGLE_APPLICATION_CREDENTIALS,GCLOUD_PROJECT"
+	assert.NoError(t, validateFlags())
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "c1", Image: "i1",
+				Env: []corev1.EnvVar{
+					{Name: "GOOGLE_APPLICATION_CREDENTIALS", Value: "/wrong/key.json"},
+					{Name: "GCLOUD_PROJECT", Value: "wrong-project"},
+					{Name: "KEEP", Value: "me"}}}}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+	assert.Equal(t, []corev1.EnvVar{
+		{Name: "KEEP", Value: "me"},
+		{Name: "GOOGLE_APPLICATION_CREDENTIALS", Value: "/var/run/secrets/gcp/sa-1/key.json"},
+	}, pod.Spec.Containers[0].Env)
+
+	*removeEnv = "NOT VALID"
+	assert.Error(t, validateFlags())
+}
+
+func Test_modifyPodSpec_secretKey(t *testing.T) {
+	defer func(v string) { *secretKey = v }(*secretKey)
+
+	tests := []struct {
+		name        string
+		flag        string
+		annotations map[string]string
+		want        string
+		wantOk      bool
+	}{
+		{"default", "key.json", nil, "key.json", true},
+		{"flag", "service-account.json", nil, "service-account.json", true},
+		{"annotation overrides flag", "service-account.json",
+			map[string]string{"iam.cloud.google.com/secret-key": "creds.json"}, "creds.json", true},
+		{"path traversal rejected", "key.json",
+			map[string]string{"iam.cloud.google.com/secret-key": "../key.json"}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*secretKey = tt.flag
+			annotations := map[string]string{"iam.cloud.google.com/service-account": "sa-1"}
+			for k, v := range tt.annotations {
+				annotations[k] = v
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Annotations: annotations},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+			assert.Equal(t, tt.wantOk, len(modifyPodSpec(pod)) > 0)
+			if !tt.wantOk {
+				return
+			}
+			assert.Equal(t, []corev1.KeyToPath{{Key: tt.want, Path: tt.want}},
+				pod.Spec.Volumes[0].Secret.Items)
+			assert.Equal(t, "/var/run/secrets/gcp/sa-1/"+tt.want, pod.Spec.Containers[0].Env[0].Value)
+		})
+	}
+
+	*secretKey = "a/b"
+	assert.Error(t, validateFlags())
+}
+
+func Test_pendingOnly(t *testing.T) {
+	var got []string
+	handler := pendingOnly(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			got = append(got, obj.(*corev1.Pod).GetName())
+		},
+	})
+
+	handler.OnAdd(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pending",
+		Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+			{Name: "serviceaccounts.cloud.google.com"}}}}})
+	handler.OnAdd(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "initialized"}})
+	handler.OnAdd(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "other-initializer",
+		Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+			{Name: "other"}, {Name: "serviceaccounts.cloud.google.com"}}}}})
+
+	assert.Equal(t, []string{"pending"}, got)
+}
+
+func Test_pendingOnly_update(t *testing.T) {
+	var updated []string
+	handler := pendingOnly(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(_, obj interface{}) {
+			updated = append(updated, obj.(*corev1.Pod).GetName())
+		},
+	})
+	pending := func(annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", Annotations: annotations,
+			Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+				{Name: "serviceaccounts.cloud.google.com"}}}}}
+	}
+	annotated := pending(map[string]string{"iam.cloud.google.com/service-account": "sa-1"})
+	initialized := annotated.DeepCopy()
+	initialized.ObjectMeta.Initializers = nil
+
+	handler.OnUpdate(pending(nil), annotated)
+	assert.Equal(t, []string{"foo"}, updated, "annotated while pending")
+
+	updated = nil
+	handler.OnUpdate(annotated, initialized)
+	handler.OnUpdate(initialized, initialized)
+	assert.Empty(t, updated, "no longer pending this initializer")
+}
+
+func Test_modifyPodSpec_mountPath(t *testing.T) {
+	defer func(v string) { *baseMountPath = v }(*baseMountPath)
+	*baseMountPath = "/etc/gcp/"
+	assert.NoError(t, validateFlags())
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+	assert.Equal(t, "/etc/gcp/sa-1", pod.Spec.Containers[0].VolumeMounts[0].MountPath)
+	assert.Equal(t, "/etc/gcp/sa-1/key.json", pod.Spec.Containers[0].Env[0].Value)
+
+	for _, invalid := range []string{"etc/gcp", "", "/"} {
+		*baseMountPath = invalid
+		assert.Error(t, validateFlags(), "-mount-path=%q", invalid)
+	}
+}
+
+func Test_modifyPodSpec_writableCopy(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{
+				"iam.cloud.google.com/service-account": "sa-1",
+				"iam.cloud.google.com/writable-copy":   "true"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+
+	assert.Len(t, pod.Spec.Volumes, 2)
+	assert.Equal(t, "gcp-sa-1", pod.Spec.Volumes[0].Name)
+	assert.Equal(t, corev1.Volume{Name: "gcp-sa-1-writable", VolumeSource: corev1.VolumeSource{
+		EmptyDir: &corev1.EmptyDirVolumeSource{}}}, pod.Spec.Volumes[1])
+
+	assert.Equal(t, []corev1.Container{{
+		Name:    "gcp-credentials-copy",
+		Image:   "busybox",
+		Command: []string{"cp", "/var/run/secrets/gcp/sa-1/key.json", "/gcp-credentials/key.json"},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "gcp-sa-1", MountPath: "/var/run/secrets/gcp/sa-1", ReadOnly: true},
+			{Name: "gcp-sa-1-writable", MountPath: "/gcp-credentials"}}}},
+		pod.Spec.InitContainers)
+
+	c := pod.Spec.Containers[0]
+	assert.Equal(t, []corev1.VolumeMount{{
+		Name:      "gcp-sa-1-writable",
+		MountPath: "/var/run/secrets/gcp/sa-1"}}, c.VolumeMounts)
+	assert.Equal(t, []corev1.EnvVar{{
+		Name:  "GOOGLE_APPLICATION_CREDENTIALS",
+		Value: "/var/run/secrets/gcp/sa-1/key.json"}}, c.Env)
+}
+
+func Test_modifyPodSpec_existingCredentialsEnv(t *testing.T) {
+	defer func(v string) { *existingCredentialsEnv = v }(*existingCredentialsEnv)
+
+	existing := corev1.EnvVar{Name: "GOOGLE_APPLICATION_CREDENTIALS", Value: "/own/key.json"}
+	injected := corev1.EnvVar{Name: "GOOGLE_APPLICATION_CREDENTIALS", Value: "/var/run/secrets/gcp/sa-1/key.json"}
+	tests := []struct {
+		name string
+		mode string
+		env  []corev1.EnvVar
+		want []corev1.EnvVar
+	}{
+		{"skip, not set", "skip", nil, []corev1.EnvVar{injected}},
+		{"skip, already set", "skip", []corev1.EnvVar{existing}, []corev1.EnvVar{existing}},
+		{"overwrite, not set", "overwrite", nil, []corev1.EnvVar{injected}},
+		{"overwrite, already set", "overwrite", []corev1.EnvVar{existing}, []corev1.EnvVar{injected}},
+		{"mount, not set", "mount", nil, []corev1.EnvVar{injected}},
+		{"mount, already set", "mount", []corev1.EnvVar{existing}, []corev1.EnvVar{existing}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*existingCredentialsEnv = tt.mode
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo",
+					Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1",
+					Env: append([]corev1.EnvVar(nil), tt.env...)}}}}
+			assert.NotEmpty(t, modifyPodSpec(pod))
+			assert.Equal(t, tt.want, pod.Spec.Containers[0].Env)
+			assert.Len(t, pod.Spec.Containers[0].VolumeMounts, 1, "the key is mounted either way")
+		})
+	}
+
+	*existingCredentialsEnv = "append"
+	assert.Error(t, validateFlags())
+}
+
+func Test_modifyPodSpec_credentialsEnvName(t *testing.T) {
+	defer func(v string) { *credentialsEnvName = v }(*credentialsEnvName)
+	defer func(n []string) { credentialsEnvNames = n }(credentialsEnvNames)
+
+	tests := []struct {
+		name    string
+		flag    string
+		wantErr bool
+		want    []string
+	}{
+		{"default", "GOOGLE_APPLICATION_CREDENTIALS", false, []string{"GOOGLE_APPLICATION_CREDENTIALS"}},
+		{"custom name", "GCP_CREDENTIALS_PATH", false, []string{"GCP_CREDENTIALS_PATH"}},
+		{"several names", "GOOGLE_APPLICATION_CREDENTIALS,GCP_CREDENTIALS_PATH", false,
+			[]string{"GOOGLE_APPLICATION_CREDENTIALS", "GCP_CREDENTIALS_PATH"}},
+		{"invalid name", "1-NOT-VALID", true, nil},
+		{"empty name", "GCP_CREDENTIALS_PATH,", true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*credentialsEnvName = tt.flag
+			err := validateFlags()
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo",
+					Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+			assert.NotEmpty(t, modifyPodSpec(pod))
+			var got []string
+			for _, e := range pod.Spec.Containers[0].Env {
+				assert.Equal(t, "/var/run/secrets/gcp/sa-1/key.json", e.Value)
+				got = append(got, e.Name)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_modifyPodSpec_mountAtExistingCredentialsPath(t *testing.T) {
+	defer func(v string) { *existingCredentialsEnv = v }(*existingCredentialsEnv)
+	*existingCredentialsEnv = "mount"
+
+	tests := []struct {
+		name string
+		env  corev1.EnvVar
+		want corev1.VolumeMount
+	}{
+		{"env path drives the mount",
+			corev1.EnvVar{Name: "GOOGLE_APPLICATION_CREDENTIALS", Value: "/etc/app/creds.json"},
+			corev1.VolumeMount{Name: "gcp-sa-1", MountPath: "/etc/app/creds.json", SubPath: "key.json", ReadOnly: true}},
+		{"relative path is ignored",
+			corev1.EnvVar{Name: "GOOGLE_APPLICATION_CREDENTIALS", Value: "creds.json"},
+			corev1.VolumeMount{Name: "gcp-sa-1", MountPath: "/var/run/secrets/gcp/sa-1", ReadOnly: true}},
+		{"other env var is ignored",
+			corev1.EnvVar{Name: "APP_CREDENTIALS", Value: "/etc/app/creds.json"},
+			corev1.VolumeMount{Name: "gcp-sa-1", MountPath: "/var/run/secrets/gcp/sa-1", ReadOnly: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo",
+					Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1",
+					Env: []corev1.EnvVar{tt.env}}}}}
+			assert.NotEmpty(t, modifyPodSpec(pod))
+			assert.Equal(t, []corev1.VolumeMount{tt.want}, pod.Spec.Containers[0].VolumeMounts)
+			assert.Equal(t, tt.env, pod.Spec.Containers[0].Env[0], "the container's env is kept")
+		})
+	}
+}
+
+func Test_modifyPodSpec_idempotent(t *testing.T) {
+	for _, writable := range []string{"false", "true"} {
+		t.Run("writable-copy="+writable, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo",
+					Annotations: map[string]string{
+						"iam.cloud.google.com/service-account": "sa-1",
+						"iam.cloud.google.com/writable-copy":   writable}},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+			assert.NotEmpty(t, modifyPodSpec(pod))
+			once := pod.DeepCopy()
+			assert.NotEmpty(t, modifyPodSpec(pod))
+
+			assert.Equal(t, once.Spec, pod.Spec)
+			assert.Len(t, pod.Spec.Containers[0].VolumeMounts, 1)
+			assert.Len(t, pod.Spec.Containers[0].Env, 1)
+		})
+	}
+}
+
+func Test_targetContainers_injectAllContainers(t *testing.T) {
+	defer func(v bool) { *injectAllContainers = v }(*injectAllContainers)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{"iam.cloud.google.com/env.worker": "GCP_KEY"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "app", Image: "i1"},
+			{Name: "sidecar", Image: "i2"},
+			{Name: "worker", Image: "i3"},
+		}}}
+
+	*injectAllContainers = false
+	assert.Equal(t, []int{0, 2}, targetContainers(pod), "first container and annotated ones")
+	*injectAllContainers = true
+	assert.Equal(t, []int{0, 1, 2}, targetContainers(pod))
+}
+
+func Test_targetContainers_containersAnnotation(t *testing.T) {
+	defer func(v bool) { *injectAllContainers = v }(*injectAllContainers)
+	*injectAllContainers = true
+
+	tests := []struct {
+		name       string
+		annotation string
+		want       []int
+	}{
+		{"one container", "worker", []int{2}},
+		{"several containers", "app, worker", []int{0, 2}},
+		{"unknown container ignored", "worker,missing", []int{2}},
+		{"only unknown containers", "missing", []int{}},
+		{"empty list", "", []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo",
+					Annotations: map[string]string{"iam.cloud.google.com/containers": tt.annotation}},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{
+					{Name: "app", Image: "i1"},
+					{Name: "sidecar", Image: "i2"},
+					{Name: "worker", Image: "i3"},
+				}}}
+			assert.Equal(t, tt.want, targetContainers(pod))
+		})
+	}
+}
+
+func Test_initializePod_logFields(t *testing.T) {
+	logger := log.StandardLogger()
+	defer func(f log.Formatter) { log.SetFormatter(f) }(logger.Formatter)
+	defer log.SetOutput(logger.Out)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFormatter(&log.JSONFormatter{})
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "team-a",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+			Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+				{Name: "serviceaccounts.cloud.google.com"}}}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "sa-1", Namespace: "team-a"}}
+	initializePod(pod, fake.NewSimpleClientset(pod, secret))
+
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "initialized pod/foo", entry["msg"])
+	assert.Equal(t, "foo", entry["pod"])
+	assert.Equal(t, "team-a", entry["namespace"])
+	assert.Equal(t, "sa-1", entry["serviceAccount"])
+	assert.Equal(t, "initialize", entry["action"])
+}
+
+func Test_stdFormatter(t *testing.T) {
+	out, err := stdFormatter{}.Format(&log.Entry{
+		Time:    time.Date(2017, 9, 1, 10, 4, 5, 0, time.UTC),
+		Message: "initialized pod/foo",
+		Data:    log.Fields{"pod": "foo"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "2017/09/01 10:04:05 initialized pod/foo\n", string(out))
+}
+
+func Test_mappedServiceAccountFor(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc,
+		cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	mapping := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "ksa-mapping", Namespace: "kube-system"},
+		Data:       map[string]string{"builder": "sa-builder"}}
+	indexer.Add(mapping)
+
+	defer func(l corelisters.ConfigMapLister) { configMapLister = l }(configMapLister)
+	configMapLister = corelisters.NewConfigMapLister(indexer)
+	defer func(v string) { *ksaMappingConfigMap = v }(*ksaMappingConfigMap)
+	*ksaMappingConfigMap = "kube-system/ksa-mapping"
+	assert.NoError(t, validateFlags())
+
+	builder := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default"},
+		Spec:       corev1.PodSpec{ServiceAccountName: "builder"}}
+	deployer := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "bar", Namespace: "default"},
+		Spec:       corev1.PodSpec{ServiceAccountName: "deployer"}}
+
+	got, ok := gcpServiceAccountFor(builder)
+	assert.True(t, ok)
+	assert.Equal(t, "sa-builder", got)
+	_, ok = gcpServiceAccountFor(deployer)
+	assert.False(t, ok, "unmapped serviceaccount")
+
+	// The informer updates the indexer when the ConfigMap changes.
+	updated := mapping.DeepCopy()
+	updated.Data = map[string]string{"builder": "sa-builder-v2", "deployer": "sa-deployer"}
+	indexer.Update(updated)
+
+	got, ok = gcpServiceAccountFor(builder)
+	assert.True(t, ok)
+	assert.Equal(t, "sa-builder-v2", got)
+	got, ok = gcpServiceAccountFor(deployer)
+	assert.True(t, ok)
+	assert.Equal(t, "sa-deployer", got)
+
+	*ksaMappingConfigMap = "ksa-mapping"
+	assert.Error(t, validateFlags())
+}
+
+func Test_initializePod_requireSecret(t *testing.T) {
+	defer func(v bool) { *requireSecret = v }(*requireSecret)
+
+	newPod := func(namespace, accounts string, inline bool) *corev1.Pod {
+		annotations := map[string]string{"iam.cloud.google.com/service-account": accounts}
+		if inline {
+			annotations["iam.cloud.google.com/inline-credentials"] = "true"
+		}
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: namespace,
+				Annotations: annotations,
+				Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+					{Name: "serviceaccounts.cloud.google.com"}}}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	}
+	tests := []struct {
+		name        string
+		namespace   string
+		accounts    string
+		inline      bool
+		secret      bool
+		strict      bool
+		wantPending bool
+	}{
+		{"secret exists", "require-secret-1", "sa-1", false, true, true, false},
+		{"missing, lenient", "require-secret-2", "sa-1", false, false, false, false},
+		{"missing, strict", "require-secret-3", "sa-1", false, false, true, true},
+		{"additional account missing", "require-secret-4", "sa-1,sa-2", false, true, true, true},
+		{"additional account not injected", "require-secret-5", "sa-1,sa-2", true, true, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*requireSecret = tt.strict
+			pod := newPod(tt.namespace, tt.accounts, tt.inline)
+			objects := []runtime.Object{pod}
+			if tt.secret {
+				objects = append(objects, &corev1.Secret{
+					ObjectMeta: metav1.ObjectMeta{Name: "sa-1", Namespace: tt.namespace}})
+			}
+			clientset := newPatchingClientset(objects...)
+
+			initializePod(pod, clientset)
+
+			got, err := clientset.CoreV1().Pods(tt.namespace).Get("foo", metav1.GetOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantPending, needsInitialization(got))
+		})
+	}
+}
+
+func Test_secretExists_cached(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "sa-1", Namespace: "secret-exists-cached"}})
+	var gets int
+	clientset.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		gets++
+		return false, nil, nil
+	})
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, secretExists(clientset, "secret-exists-cached", "sa-1"))
+		assert.False(t, secretExists(clientset, "secret-exists-cached", "sa-2"))
+	}
+	assert.Equal(t, 2, gets, "one lookup per secret")
+}
+
+// slowSecretsClientset counts the secret Gets in flight, which the fake
+// clientset would serialize as it runs its reactors under a lock.
+type slowSecretsClientset struct {
+	*fake.Clientset
+	inFlight, maxInFlight int32
+}
+
+func (c *slowSecretsClientset) CoreV1() typedcorev1.CoreV1Interface {
+	return slowSecretsCoreV1{c.Clientset.CoreV1(), c}
+}
+
+type slowSecretsCoreV1 struct {
+	typedcorev1.CoreV1Interface
+	c *slowSecretsClientset
+}
+
+func (v slowSecretsCoreV1) Secrets(namespace string) typedcorev1.SecretInterface {
+	return slowSecrets{v.CoreV1Interface.Secrets(namespace), v.c}
+}
+
+type slowSecrets struct {
+	typedcorev1.SecretInterface
+	c *slowSecretsClientset
+}
+
+func (s slowSecrets) Get(name string, options metav1.GetOptions) (*corev1.Secret, error) {
+	n := atomic.AddInt32(&s.c.inFlight, 1)
+	defer atomic.AddInt32(&s.c.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(&s.c.maxInFlight)
+		if n <= max || atomic.CompareAndSwapInt32(&s.c.maxInFlight, max, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return s.SecretInterface.Get(name, options)
+}
+
+func Test_secretExists_concurrencyBound(t *testing.T) {
+	defer func(s chan struct{}) { secretLookupSlots = s }(secretLookupSlots)
+	defer func(c *utilcache.LRUExpireCache) { secretLookups = c }(secretLookups)
+
+	for _, bound := range []int{1, 3} {
+		secretLookupSlots = make(chan struct{}, bound)
+		secretLookups = utilcache.NewLRUExpireCache(1024)
+		clientset := &slowSecretsClientset{Clientset: fake.NewSimpleClientset()}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 30; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				secretExists(clientset, "secret-exists-burst", fmt.Sprintf("sa-%d", i))
+			}(i)
+		}
+		wg.Wait()
+		assert.Equal(t, int32(bound), clientset.maxInFlight, "lookups in flight")
+	}
+}
+
+func Test_initializePod_events(t *testing.T) {
+	defer func(r record.EventRecorder) { recorder = r }(recorder)
+
+	newPod := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "initialize-events",
+				Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+				Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+					{Name: "serviceaccounts.cloud.google.com"}}}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "sa-1", Namespace: "initialize-events"}}
+
+	fakeRecorder := record.NewFakeRecorder(1)
+	recorder = fakeRecorder
+	pod := newPod()
+	initializePod(pod, fake.NewSimpleClientset(pod, secret))
+	assert.Equal(t, "Normal CredentialsInjected Injected credentials of service account sa-1",
+		<-fakeRecorder.Events)
+
+	fakeRecorder = record.NewFakeRecorder(1)
+	recorder = fakeRecorder
+	pod = newPod()
+	clientset := fake.NewSimpleClientset(pod, secret)
+	clientset.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "pods"},
+			"foo", errors.New("denied"))
+	})
+	initializePod(pod, clientset)
+	assert.Equal(t, "Warning InjectionFailed Failed to initialize pod: Forbidden", <-fakeRecorder.Events)
+}
+
+func Test_initializePod_dryRun(t *testing.T) {
+	defer func(v, i bool) { *dryRun, *dryRunInitialize = v, i }(*dryRun, *dryRunInitialize)
+	*dryRun = true
+
+	tests := []struct {
+		name        string
+		initialize  bool
+		wantPatches int
+		wantPending bool
+	}{
+		{"initializer removed", true, 1, false},
+		{"left pending", false, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*dryRunInitialize = tt.initialize
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "dry-run",
+					Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+					Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+						{Name: "serviceaccounts.cloud.google.com"}}}},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+			clientset := newPatchingClientset(pod)
+
+			initializePod(pod, clientset)
+
+			var patches int
+			for _, a := range clientset.Actions() {
+				if a.GetVerb() == "patch" {
+					patches++
+				}
+			}
+			assert.Equal(t, tt.wantPatches, patches)
+			got, err := clientset.CoreV1().Pods("dry-run").Get("foo", metav1.GetOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantPending, needsInitialization(got))
+			assert.Empty(t, got.Spec.Volumes, "dry run must not inject")
+			assert.Empty(t, got.Spec.Containers[0].Env, "dry run must not inject")
+		})
+	}
+}
+
+func Test_initializePod_patchRetry(t *testing.T) {
+	defer func(n int, d time.Duration) { *patchRetries, *patchRetryDelay = n, d }(*patchRetries, *patchRetryDelay)
+	*patchRetries = 2
+	*patchRetryDelay = time.Millisecond
+
+	tests := []struct {
+		name        string
+		err         error
+		failures    int
+		wantPatches int
+		wantPending bool
+	}{
+		{"no failure", nil, 0, 1, false},
+		{"transient failures", apierrors.NewServerTimeout(schema.GroupResource{Resource: "pods"}, "patch", 1), 2, 3, false},
+		{"conflict", apierrors.NewConflict(schema.GroupResource{Resource: "pods"}, "foo", errors.New("changed")), 1, 2, false},
+		{"retries exhausted", errors.New("connection refused"), 3, 3, true},
+		{"not retried", apierrors.NewBadRequest("bad patch"), 1, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "patch-retry",
+					Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+					Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+						{Name: "serviceaccounts.cloud.google.com"}}}},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+			clientset := newPatchingClientset(pod)
+			var patches int
+			clientset.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				patches++
+				if patches <= tt.failures {
+					return true, nil, tt.err
+				}
+				return false, nil, nil
+			})
+
+			initializePod(pod, clientset)
+
+			assert.Equal(t, tt.wantPatches, patches)
+			got, err := clientset.CoreV1().Pods("patch-retry").Get("foo", metav1.GetOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantPending, needsInitialization(got))
+			if !tt.wantPending {
+				assert.Len(t, got.Spec.Volumes, 1)
+			}
+		})
+	}
+}
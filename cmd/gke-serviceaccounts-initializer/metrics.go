@@ -0,0 +1,118 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	podsProcessed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "initializer_pods_processed_total",
+		Help: "Pods pending this initializer that were processed by this replica.",
+	})
+	injections = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "initializer_injections_total",
+		Help: "Pods saved with service account credentials injected.",
+	})
+	patchErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "initializer_patch_errors_total",
+		Help: "Pod patches rejected by or failed against the API server.",
+	})
+	patchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "initializer_patch_duration_seconds",
+		Help:    "Latency of pod patch requests.",
+		Buckets: prometheus.DefBuckets,
+	})
+	decisionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "initializer_decisions_total",
+		Help: "Objects initialized, by the reason they were or were not injected.",
+	}, []string{"reason"})
+	processingDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "initializer_processing_duration_seconds",
+		Help:    "Time from an object being queued to being initialized, including retries, by kind.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 15),
+	}, []string{"kind"})
+)
+
+// Reasons counted by initializer_decisions_total.
+const (
+	reasonInjected          = "injected"
+	reasonNoAnnotation      = "no_annotation"
+	reasonOptOut            = "opt_out"
+	reasonSecretMissing     = "secret_missing"
+	reasonInvalidAnnotation = "invalid_annotation"
+	reasonExcludedNamespace = "excluded_namespace"
+	reasonWorkloadIdentity  = "workload_identity"
+	reasonAlreadyInjected   = "already_injected"
+	reasonDryRun            = "dry_run"
+	reasonPatchFailed       = "patch_failed"
+	reasonFailOpen          = "fail_open"
+)
+
+func init() {
+	prometheus.MustRegister(podsProcessed, injections, patchErrors, patchDuration, decisionsTotal, processingDuration)
+}
+
+// serveMetrics serves the Prometheus metrics on addr at /metrics. If token is
+// non-empty, scrapes must present it as a bearer token.
+func serveMetrics(addr, token string) {
+	log.Printf("Serving metrics on %s/metrics", addr)
+	log.Fatal(http.ListenAndServe(addr, metricsMux(token)))
+}
+
+func metricsMux(token string) *http.ServeMux {
+	var h http.Handler = promhttp.Handler()
+	if token != "" {
+		h = requireBearerToken(token, h)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", h)
+	return mux
+}
+
+// requireBearerToken rejects requests whose Authorization header does not
+// carry token with 401 Unauthorized.
+func requireBearerToken(token string, h http.Handler) http.Handler {
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// loadMetricsToken reads the bearer token from file, ignoring surrounding
+// whitespace such as the trailing newline of a mounted secret.
+func loadMetricsToken(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", file)
+	}
+	return token, nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	appsv1beta1 "k8s.io/api/apps/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func Test_initializePod_metrics(t *testing.T) {
+	newPod := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default",
+				Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+				Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+					{Name: "serviceaccounts.cloud.google.com"}}}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	}
+	processed := testutil.ToFloat64(podsProcessed)
+	injected := testutil.ToFloat64(injections)
+	failed := testutil.ToFloat64(patchErrors)
+
+	pod := newPod()
+	initializePod(pod, fake.NewSimpleClientset(pod))
+	assert.Equal(t, processed+1, testutil.ToFloat64(podsProcessed))
+	assert.Equal(t, injected+1, testutil.ToFloat64(injections))
+	assert.Equal(t, failed, testutil.ToFloat64(patchErrors))
+
+	defer func(v int) { *patchRetries = v }(*patchRetries)
+	*patchRetries = 0
+	pod = newPod()
+	clientset := fake.NewSimpleClientset(pod)
+	clientset.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+	initializePod(pod, clientset)
+	assert.Equal(t, processed+2, testutil.ToFloat64(podsProcessed))
+	assert.Equal(t, injected+1, testutil.ToFloat64(injections))
+	assert.Equal(t, failed+1, testutil.ToFloat64(patchErrors))
+}
+
+func Test_metricsMux_tokenAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{"no auth", "", "", http.StatusOK},
+		{"unauthenticated", "s3cret", "", http.StatusUnauthorized},
+		{"wrong token", "s3cret", "Bearer nope", http.StatusUnauthorized},
+		{"not bearer", "s3cret", "s3cret", http.StatusUnauthorized},
+		{"valid token", "s3cret", "Bearer s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			metricsMux(tt.token).ServeHTTP(rec, req)
+			assert.Equal(t, tt.want, rec.Code)
+		})
+	}
+}
+
+func Test_initQueue_processingDuration(t *testing.T) {
+	samples := func() uint64 {
+		var m dto.Metric
+		assert.NoError(t, processingDuration.WithLabelValues("pod").(prometheus.Histogram).Write(&m))
+		return m.GetHistogram().GetSampleCount()
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+			Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+				{Name: "serviceaccounts.cloud.google.com"}}}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	assert.NoError(t, store.Add(pod))
+	clientset := newPatchingClientset(pod)
+	fail := true
+	clientset.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if fail {
+			return true, nil, errors.New("rejected")
+		}
+		return false, nil, nil
+	})
+	q := newPodQueue(workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(0, 0)), store, clientset)
+	defer q.queue.ShutDown()
+
+	before := samples()
+	q.enqueue(pod)
+	assert.True(t, q.processNext())
+	assert.Equal(t, before, samples(), "failed patches are not observed")
+
+	fail = false
+	assert.True(t, q.processNext(), "requeued pod is retried")
+	assert.Equal(t, before+1, samples())
+	assert.Empty(t, q.enqueued)
+}
+
+func Test_initializePod_decisions(t *testing.T) {
+	defer func(d map[string]bool) { deniedNamespaces = d }(deniedNamespaces)
+	defer func(r, d bool, n int) { *requireSecret, *dryRun, *patchRetries = r, d, n }(*requireSecret, *dryRun, *patchRetries)
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		setup       func()
+		failPatch   bool
+		want        string
+	}{
+		{"injected", map[string]string{"iam.cloud.google.com/service-account": "sa-1"}, nil, false, reasonInjected},
+		{"no annotation", nil, nil, false, reasonNoAnnotation},
+		{"opt out", map[string]string{"iam.cloud.google.com/service-account": "sa-1",
+			"iam.cloud.google.com/inject": "false"}, nil, false, reasonOptOut},
+		{"invalid inject value", map[string]string{"iam.cloud.google.com/service-account": "sa-1",
+			"iam.cloud.google.com/inject": "maybe"}, nil, false, reasonInvalidAnnotation},
+		{"invalid secret name", map[string]string{"iam.cloud.google.com/service-account": "Not_Valid"},
+			nil, false, reasonInvalidAnnotation},
+		{"excluded namespace", map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+			func() { deniedNamespaces = map[string]bool{"default": true} }, false, reasonExcludedNamespace},
+		{"secret missing", map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+			func() { *requireSecret = true }, false, reasonSecretMissing},
+		{"dry run", map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+			func() { *dryRun = true }, false, reasonDryRun},
+		{"patch failed", map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+			func() { *patchRetries = 0 }, true, reasonPatchFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deniedNamespaces, *requireSecret, *dryRun, *patchRetries = nil, false, false, 3
+			if tt.setup != nil {
+				tt.setup()
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "default",
+					Annotations: tt.annotations,
+					Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+						{Name: "serviceaccounts.cloud.google.com"}}}},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+			clientset := newPatchingClientset(pod)
+			if tt.failPatch {
+				clientset.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, errors.New("connection refused")
+				})
+			}
+			before := testutil.ToFloat64(decisionsTotal.WithLabelValues(tt.want))
+
+			initializePod(pod, clientset)
+			assert.Equal(t, before+1, testutil.ToFloat64(decisionsTotal.WithLabelValues(tt.want)))
+		})
+	}
+}
+
+func Test_initializeStatefulSet_decisions(t *testing.T) {
+	annotations := map[string]string{"iam.cloud.google.com/service-account": "sa-1"}
+	tests := []struct {
+		name    string
+		volumes []corev1.Volume
+		want    string
+	}{
+		{"injected", nil, reasonInjected},
+		{"already injected", []corev1.Volume{{Name: "gcp-sa-1"}}, reasonAlreadyInjected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ss := &appsv1beta1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default",
+					Annotations: annotations,
+					Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+						{Name: "serviceaccounts.cloud.google.com"}}}},
+				Spec: appsv1beta1.StatefulSetSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{Volumes: tt.volumes,
+							Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}}}
+			before := testutil.ToFloat64(decisionsTotal.WithLabelValues(tt.want))
+
+			assert.NoError(t, initializeStatefulSet(ss, newPatchingClientset(ss)))
+			assert.Equal(t, before+1, testutil.ToFloat64(decisionsTotal.WithLabelValues(tt.want)))
+		})
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"plugin"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// mutateSymbol is the function a -transform-plugin must export.
+const mutateSymbol = "Mutate"
+
+// transformPod is loaded from -transform-plugin and is nil when it is unset.
+var transformPod func(*corev1.Pod)
+
+// loadTransformPlugin opens the Go plugin at file and returns its Mutate
+// function, which must have the signature func(*corev1.Pod). The plugin must
+// be built with -buildmode=plugin against the same versions of the packages
+// this binary was built with.
+func loadTransformPlugin(file string) (func(*corev1.Pod), error) {
+	p, err := plugin.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open plugin %s (is it built with -buildmode=plugin "+
+			"against the same package versions?): %+v", file, err)
+	}
+	sym, err := p.Lookup(mutateSymbol)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s: %+v", file, err)
+	}
+	mutate, ok := sym.(func(*corev1.Pod))
+	if !ok {
+		return nil, fmt.Errorf("plugin %s: %s is a %T, want func(*v1.Pod)", file, mutateSymbol, sym)
+	}
+	return mutate, nil
+}
+
+// mutatePod injects the pod with modifyPodSpec, then hands it to the
+// -transform-plugin if any. Like modifyPodSpec, the plugin may be run again
+// on a pod it already mutated and must be idempotent. Workload pod templates
+// are injected with modifyPodSpec alone, so the plugin only ever sees real
+// pods.
+func mutatePod(pod *corev1.Pod) []string {
+	names := modifyPodSpec(pod)
+	if len(names) == 0 {
+		return nil
+	}
+	if transformPod != nil {
+		transformPod(pod)
+	}
+	return names
+}
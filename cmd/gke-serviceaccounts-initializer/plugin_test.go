@@ -0,0 +1,81 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_loadTransformPlugin(t *testing.T) {
+	defer func(v string) { *transformPlugin = v }(*transformPlugin)
+	*transformPlugin = "/plugins/mutate.so"
+	assert.Equal(t, pluginsSupported, validateFlags() == nil, "unusable plugins are rejected upfront")
+	*transformPlugin = ""
+
+	if !pluginsSupported {
+		t.Skipf("plugins are not supported without cgo or on %s", runtime.GOOS)
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skipf("the go toolchain is needed to build the fixture plugin: %+v", err)
+	}
+	dir, err := ioutil.TempDir("", "plugin")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	so := filepath.Join(dir, "labelplugin.so")
+	out, err := exec.Command("go", "build", "-buildmode=plugin", "-o", so, "./testdata/labelplugin").CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to build fixture plugin: %+v\n%s", err, out)
+	}
+	defer func(f func(*corev1.Pod)) { transformPod = f }(transformPod)
+	transformPod, err = loadTransformPlugin(so)
+	assert.NoError(t, err)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.NotEmpty(t, mutatePod(pod))
+	assert.Equal(t, "true", pod.Labels["transformed"])
+	assert.Len(t, pod.Spec.Volumes, 1, "the plugin runs after the built-in injection")
+
+	skipped := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "bar"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.Empty(t, mutatePod(skipped))
+	assert.Empty(t, skipped.Labels, "pods that are not injected are not transformed")
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "job",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}}}
+	assert.True(t, modifyPodTemplate(job, &job.Spec.Template))
+	assert.Empty(t, job.Spec.Template.Labels, "workload templates are not transformed")
+
+	notPlugin := filepath.Join(dir, "not-a-plugin.so")
+	assert.NoError(t, ioutil.WriteFile(notPlugin, []byte("not a plugin"), 0600))
+	_, err = loadTransformPlugin(notPlugin)
+	assert.Error(t, err)
+	_, err = loadTransformPlugin(filepath.Join(dir, "missing.so"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,181 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// podKeyPriority returns the -namespace-priorities priority of the
+// namespace of a queued pod key.
+func podKeyPriority(item interface{}) int {
+	namespace, _, err := cache.SplitMetaNamespaceKey(item.(string))
+	if err != nil {
+		return 0
+	}
+	return namespacePriorities[namespace]
+}
+
+// priorityQueue is a workqueue.RateLimitingInterface handing out the items
+// of highest priority first, and items of equal priority oldest first, so a
+// backlog in critical namespaces is cleared before the rest. Like the
+// client-go queues, an item is queued at most once and is never handed out
+// again before it is done.
+type priorityQueue struct {
+	priority func(item interface{}) int
+	limiter  workqueue.RateLimiter
+
+	cond         *sync.Cond
+	items        priorityItems
+	seq          int64
+	dirty        map[interface{}]bool
+	processing   map[interface{}]bool
+	shuttingDown bool
+}
+
+// newPriorityQueue returns a priorityQueue ordering items by priority and
+// delaying rate limited items with limiter.
+func newPriorityQueue(limiter workqueue.RateLimiter, priority func(item interface{}) int) *priorityQueue {
+	return &priorityQueue{
+		priority:   priority,
+		limiter:    limiter,
+		cond:       sync.NewCond(&sync.Mutex{}),
+		dirty:      make(map[interface{}]bool),
+		processing: make(map[interface{}]bool),
+	}
+}
+
+// Add queues item unless it is already queued. An item being processed is
+// queued again once it is done.
+func (q *priorityQueue) Add(item interface{}) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if q.shuttingDown || q.dirty[item] {
+		return
+	}
+	q.dirty[item] = true
+	if q.processing[item] {
+		return
+	}
+	q.push(item)
+}
+
+// push adds item to the heap. q.cond.L must be held.
+func (q *priorityQueue) push(item interface{}) {
+	q.seq++
+	heap.Push(&q.items, priorityItem{item: item, priority: q.priority(item), seq: q.seq})
+	q.cond.Signal()
+}
+
+// Len returns the number of items queued.
+func (q *priorityQueue) Len() int {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return len(q.items)
+}
+
+// Get blocks until an item is queued and returns the one of highest
+// priority. It returns shutdown true once the queue is shut down and empty.
+func (q *priorityQueue) Get() (item interface{}, shutdown bool) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	for len(q.items) == 0 && !q.shuttingDown {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 {
+		return nil, true
+	}
+	item = heap.Pop(&q.items).(priorityItem).item
+	q.processing[item] = true
+	delete(q.dirty, item)
+	return item, false
+}
+
+// Done marks item as processed, queuing it again if it was added meanwhile.
+func (q *priorityQueue) Done(item interface{}) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	delete(q.processing, item)
+	if q.dirty[item] {
+		q.push(item)
+	}
+}
+
+// ShutDown stops accepting items; Get still hands out the queued ones.
+func (q *priorityQueue) ShutDown() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.shuttingDown = true
+	q.cond.Broadcast()
+}
+
+// ShuttingDown reports whether ShutDown was called.
+func (q *priorityQueue) ShuttingDown() bool {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	return q.shuttingDown
+}
+
+// AddAfter adds item once the duration has passed.
+func (q *priorityQueue) AddAfter(item interface{}, duration time.Duration) {
+	if duration <= 0 {
+		q.Add(item)
+		return
+	}
+	time.AfterFunc(duration, func() { q.Add(item) })
+}
+
+// AddRateLimited adds item after the delay given by the rate limiter.
+func (q *priorityQueue) AddRateLimited(item interface{}) {
+	q.AddAfter(item, q.limiter.When(item))
+}
+
+// Forget resets the rate limiting of item.
+func (q *priorityQueue) Forget(item interface{}) {
+	q.limiter.Forget(item)
+}
+
+// NumRequeues returns how many times item was rate limited.
+func (q *priorityQueue) NumRequeues(item interface{}) int {
+	return q.limiter.NumRequeues(item)
+}
+
+type priorityItem struct {
+	item     interface{}
+	priority int
+	seq      int64
+}
+
+// priorityItems is a heap of items, highest priority and lowest sequence
+// number first.
+type priorityItems []priorityItem
+
+func (h priorityItems) Len() int { return len(h) }
+func (h priorityItems) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+func (h priorityItems) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *priorityItems) Push(x interface{}) { *h = append(*h, x.(priorityItem)) }
+func (h *priorityItems) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
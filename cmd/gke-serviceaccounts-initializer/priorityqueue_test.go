@@ -0,0 +1,65 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func Test_priorityQueue(t *testing.T) {
+	defer func(v string) { *namespacePriority = v }(*namespacePriority)
+	defer func(m map[string]int) { namespacePriorities = m }(namespacePriorities)
+	*namespacePriority = "critical=10,batch=-1"
+	assert.NoError(t, validateFlags())
+	q := newPriorityQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Hour, time.Hour), podKeyPriority)
+
+	for _, key := range []string{"batch/a", "default/b", "critical/c", "default/d", "critical/e", "default/b"} {
+		q.Add(key)
+	}
+	assert.Equal(t, 5, q.Len(), "an item is queued once")
+	var got []interface{}
+	for q.Len() > 0 {
+		item, shutdown := q.Get()
+		assert.False(t, shutdown)
+		got = append(got, item)
+		q.Done(item)
+	}
+	assert.Equal(t, []interface{}{"critical/c", "critical/e", "default/b", "default/d", "batch/a"}, got,
+		"higher priority namespaces first, then oldest first")
+
+	q.Add("default/b")
+	item, _ := q.Get()
+	q.Add("default/b")
+	assert.Equal(t, 0, q.Len(), "an item being processed is not handed out again")
+	q.Done(item)
+	assert.Equal(t, 1, q.Len(), "an item added while processed is queued once done")
+
+	q.AddRateLimited("default/f")
+	assert.Equal(t, 1, q.NumRequeues("default/f"))
+	assert.Equal(t, 1, q.Len(), "rate limited items are delayed")
+
+	q.ShutDown()
+	q.Add("critical/g")
+	item, shutdown := q.Get()
+	assert.Equal(t, "default/b", item, "queued items are still handed out after shutdown")
+	assert.False(t, shutdown)
+	q.Done(item)
+	_, shutdown = q.Get()
+	assert.True(t, shutdown)
+
+	*namespacePriority = "critical=high"
+	assert.Error(t, validateFlags())
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// profile is a named set of env vars and a default service account that pods
+// select with the "iam.cloud.google.com/profile" annotation.
+type profile struct {
+	// ServiceAccount is the secret injected unless the pod names one itself.
+	ServiceAccount string            `json:"serviceAccount,omitempty"`
+	Env            map[string]string `json:"env,omitempty"`
+}
+
+// profiles is loaded from -profiles-file.
+var profiles map[string]profile
+
+// loadProfiles reads the profiles from a YAML file mapping profile names to
+// their definitions, e.g.:
+//
+//	bigquery:
+//	  serviceAccount: bq-reader
+//	  env:
+//	    BIGQUERY_DATASET: analytics
+func loadProfiles(file string) (map[string]profile, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]profile
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %+v", file, err)
+	}
+	for name, p := range m {
+		for env := range p.Env {
+			if errs := validation.IsEnvVarName(env); len(errs) > 0 {
+				return nil, fmt.Errorf("profile %s: env %q: %s", name, env, strings.Join(errs, "; "))
+			}
+		}
+	}
+	return m, nil
+}
+
+// profileFor returns the profile selected by the pod's
+// "iam.cloud.google.com/profile" annotation. Unknown profiles are logged.
+func profileFor(pod *corev1.Pod) (profile, bool) {
+	name, ok := pod.ObjectMeta.Annotations[profileAnnotation]
+	if !ok {
+		return profile{}, false
+	}
+	p, ok := profiles[name]
+	if !ok {
+		log.Printf("warning: pod/%s selects unknown profile %q", pod.GetName(), name)
+	}
+	return p, ok
+}
+
+// profileServiceAccountFor returns the default service account of the pod's
+// profile.
+func profileServiceAccountFor(pod *corev1.Pod) (string, bool) {
+	p, ok := profileFor(pod)
+	if !ok || p.ServiceAccount == "" {
+		return "", false
+	}
+	return p.ServiceAccount, true
+}
+
+// profileEnvVars returns the env vars of the pod's profile, sorted by name.
+func profileEnvVars(pod *corev1.Pod) []corev1.EnvVar {
+	p, ok := profileFor(pod)
+	if !ok {
+		return nil
+	}
+	names := make([]string, 0, len(p.Env))
+	for name := range p.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	vars := make([]corev1.EnvVar, 0, len(names))
+	for _, name := range names {
+		vars = append(vars, corev1.EnvVar{Name: name, Value: p.Env[name]})
+	}
+	return vars
+}
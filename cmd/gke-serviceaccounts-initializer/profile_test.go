@@ -0,0 +1,94 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_loadProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiles")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	valid := filepath.Join(dir, "valid.yaml")
+	assert.NoError(t, ioutil.WriteFile(valid, []byte(`
+bigquery:
+  serviceAccount: bq-reader
+  env:
+    BIGQUERY_DATASET: analytics
+pubsub:
+  env:
+    PUBSUB_TOPIC: events
+`), 0600))
+	got, err := loadProfiles(valid)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]profile{
+		"bigquery": {ServiceAccount: "bq-reader", Env: map[string]string{"BIGQUERY_DATASET": "analytics"}},
+		"pubsub":   {Env: map[string]string{"PUBSUB_TOPIC": "events"}},
+	}, got)
+
+	invalid := filepath.Join(dir, "invalid.yaml")
+	assert.NoError(t, ioutil.WriteFile(invalid, []byte("bigquery:\n  env:\n    \"NOT VALID\": x\n"), 0600))
+	_, err = loadProfiles(invalid)
+	assert.Error(t, err)
+
+	_, err = loadProfiles(filepath.Join(dir, "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func Test_modifyPodSpec_profile(t *testing.T) {
+	defer func(p map[string]profile) { profiles = p }(profiles)
+	profiles = map[string]profile{
+		"bigquery": {ServiceAccount: "bq-reader",
+			Env: map[string]string{"BIGQUERY_DATASET": "analytics", "BIGQUERY_LOCATION": "EU"}},
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantOk      bool
+		wantSecret  string
+	}{
+		{"profile service account", map[string]string{"iam.cloud.google.com/profile": "bigquery"},
+			true, "bq-reader"},
+		{"pod annotation wins", map[string]string{"iam.cloud.google.com/profile": "bigquery",
+			"iam.cloud.google.com/service-account": "sa-1"}, true, "sa-1"},
+		{"unknown profile", map[string]string{"iam.cloud.google.com/profile": "spanner"}, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Annotations: tt.annotations},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1",
+					Env: []corev1.EnvVar{{Name: "BIGQUERY_LOCATION", Value: "US"}}}}}}
+			assert.Equal(t, tt.wantOk, len(modifyPodSpec(pod)) > 0)
+			if !tt.wantOk {
+				return
+			}
+			assert.Equal(t, tt.wantSecret, pod.Spec.Volumes[0].Secret.SecretName)
+			assert.Equal(t, []corev1.EnvVar{
+				{Name: "BIGQUERY_LOCATION", Value: "US"},
+				{Name: "GOOGLE_APPLICATION_CREDENTIALS",
+					Value: "/var/run/secrets/gcp/" + tt.wantSecret + "/key.json"},
+				{Name: "BIGQUERY_DATASET", Value: "analytics"},
+			}, pod.Spec.Containers[0].Env, "the pod's own env is not overridden")
+		})
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// initQueue hands the objects pending this initializer from an informer to
+// worker goroutines, so slow patches don't block the informer and objects
+// whose initialization failed are retried with rate limiting.
+type initQueue struct {
+	// processed counts the objects taken off the queue. It is accessed
+	// atomically and kept first for 64-bit alignment.
+	processed int64
+
+	queue workqueue.RateLimitingInterface
+	store cache.Store
+	// initialize initializes an object from store, returning an error if it
+	// is left pending and should be retried.
+	initialize func(obj interface{}) error
+
+	// limiter, if set, paces the processing of the backlog: the objects
+	// queued before synced returned true. The informer reports synced as
+	// soon as it has queued its initial list, long before the workers are
+	// done with it.
+	limiter flowcontrol.RateLimiter
+	synced  func() bool
+
+	mu      sync.Mutex
+	backlog map[string]bool
+	// enqueued records when each queued key was first enqueued, so the
+	// processing duration includes the time spent queued and retried.
+	enqueued map[string]time.Time
+
+	// workers tracks the goroutines started by start.
+	workers sync.WaitGroup
+}
+
+// newInitQueue returns an initQueue initializing the objects it is given,
+// looked up by key in store, with initialize.
+func newInitQueue(queue workqueue.RateLimitingInterface, store cache.Store,
+	initialize func(obj interface{}) error) *initQueue {
+	return &initQueue{
+		queue:      queue,
+		store:      store,
+		initialize: initialize,
+		synced:     func() bool { return true },
+		backlog:    make(map[string]bool),
+		enqueued:   make(map[string]time.Time),
+	}
+}
+
+// newPodQueue returns an initQueue initializing the pods it is given through
+// queue.
+func newPodQueue(queue workqueue.RateLimitingInterface, store cache.Store, clientset kubernetes.Interface) *initQueue {
+	return newInitQueue(queue, store, func(obj interface{}) error {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok {
+			log.Fatalf("store returned non-pod object: %T", obj)
+		}
+		return initializePod(pod, clientset)
+	})
+}
+
+// newWorkloadQueue returns an initQueue initializing the workloads it is
+// given through queue.
+func newWorkloadQueue(queue workqueue.RateLimitingInterface, store cache.Store, clientset kubernetes.Interface) *initQueue {
+	return newInitQueue(queue, store, func(obj interface{}) error {
+		return initializeAnyWorkload(obj, clientset)
+	})
+}
+
+// enqueue adds the key of an object received from the informer to the queue.
+func (q *initQueue) enqueue(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		log.Printf("failed to get key of %T: %+v", obj, err)
+		return
+	}
+	q.mu.Lock()
+	if q.limiter != nil && !q.synced() {
+		q.backlog[key] = true
+	}
+	if _, ok := q.enqueued[key]; !ok {
+		q.enqueued[key] = time.Now()
+	}
+	q.mu.Unlock()
+	q.queue.Add(key)
+}
+
+// throttleBacklog blocks on the limiter if key is part of the backlog, which
+// it leaves, so only the first attempt at a backlog object is paced.
+func (q *initQueue) throttleBacklog(key string) {
+	q.mu.Lock()
+	inBacklog := q.backlog[key]
+	delete(q.backlog, key)
+	q.mu.Unlock()
+	if inBacklog {
+		q.limiter.Accept()
+	}
+}
+
+// reconcile queues every initialized workload in the store that was injected
+// before, so that the workers re-inject those that lost the injection. The
+// informer only hands over objects pending this initializer, which its
+// resyncs already retry. Pods are never reconciled, as their spec cannot
+// change once initialized.
+func (q *initQueue) reconcile() {
+	for _, obj := range q.store.List() {
+		o, ok := obj.(metav1.Object)
+		if !ok || !reinjectable(o) {
+			continue
+		}
+		q.enqueue(obj)
+	}
+}
+
+// start processes the queue with the given number of workers until shutdown
+// is called.
+func (q *initQueue) start(workers int) {
+	for i := 0; i < workers; i++ {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			q.work()
+		}()
+	}
+}
+
+// shutdown is shutdownQueues for q alone.
+func (q *initQueue) shutdown(timeout time.Duration) (int, bool) {
+	return shutdownQueues([]*initQueue{q}, timeout)
+}
+
+// shutdownQueues stops the queues accepting objects and waits up to timeout
+// for their workers to finish the objects already queued or being patched,
+// so none is left half processed. It returns the number of objects drained
+// and whether the workers finished in time. Objects requeued after a failure
+// are dropped; another replica or the next start picks them up as they are
+// still pending.
+func shutdownQueues(queues []*initQueue, timeout time.Duration) (int, bool) {
+	processed := func() int64 {
+		var n int64
+		for _, q := range queues {
+			n += atomic.LoadInt64(&q.processed)
+		}
+		return n
+	}
+	before := processed()
+	for _, q := range queues {
+		q.queue.ShutDown()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for _, q := range queues {
+			q.workers.Wait()
+		}
+		close(done)
+	}()
+	finished := true
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		finished = false
+	}
+	return int(processed() - before), finished
+}
+
+// work processes objects until the queue is shut down.
+func (q *initQueue) work() {
+	for q.processNext() {
+	}
+}
+
+// processNext initializes the latest version of the next object in the
+// queue, requeuing it with rate limiting if that fails. It returns false once
+// the queue is shut down.
+func (q *initQueue) processNext() bool {
+	key, quit := q.queue.Get()
+	if quit {
+		return false
+	}
+	defer q.queue.Done(key)
+	defer atomic.AddInt64(&q.processed, 1)
+
+	obj, exists, err := q.store.GetByKey(key.(string))
+	if err != nil || !exists {
+		// The object was deleted since it was queued.
+		q.queue.Forget(key)
+		q.sinceEnqueued(key.(string))
+		return true
+	}
+
+	q.throttleBacklog(key.(string))
+	if err := q.initialize(obj); err != nil {
+		log.Printf("requeuing %s: %+v", key, err)
+		q.queue.AddRateLimited(key)
+		return true
+	}
+	q.queue.Forget(key)
+	if start, ok := q.sinceEnqueued(key.(string)); ok {
+		if o, ok := obj.(metav1.Object); ok {
+			processingDuration.WithLabelValues(kindOf(o)).Observe(time.Since(start).Seconds())
+		}
+	}
+	return true
+}
+
+// sinceEnqueued returns when key was first enqueued, if it was, and forgets
+// it so the next enqueue starts a new measurement.
+func (q *initQueue) sinceEnqueued(key string) (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	start, ok := q.enqueued[key]
+	delete(q.enqueued, key)
+	return start, ok
+}
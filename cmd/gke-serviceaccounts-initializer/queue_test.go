@@ -0,0 +1,185 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func Test_initQueue_processNext(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo", Namespace: "pod-queue",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+			Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+				{Name: "serviceaccounts.cloud.google.com"}}}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	assert.NoError(t, store.Add(pod))
+	clientset := newPatchingClientset(pod)
+	fail := true
+	clientset.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if fail {
+			return true, nil, apierrors.NewBadRequest("rejected")
+		}
+		return false, nil, nil
+	})
+	// Requeued pods are never due during the test.
+	q := newPodQueue(workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Hour, time.Hour)), store, clientset)
+
+	q.enqueue(pod)
+	assert.True(t, q.processNext())
+	assert.Equal(t, 1, q.queue.NumRequeues("pod-queue/foo"), "failed pod is requeued")
+
+	fail = false
+	q.queue.Forget("pod-queue/foo")
+	q.enqueue(pod)
+	assert.True(t, q.processNext())
+	assert.Equal(t, 0, q.queue.NumRequeues("pod-queue/foo"))
+	got, err := clientset.CoreV1().Pods("pod-queue").Get("foo", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.False(t, needsInitialization(got))
+
+	assert.NoError(t, store.Delete(pod))
+	q.enqueue(pod)
+	assert.True(t, q.processNext(), "deleted pod is dropped")
+	assert.Equal(t, 0, q.queue.NumRequeues("pod-queue/foo"))
+
+	q.queue.ShutDown()
+	assert.False(t, q.processNext())
+}
+
+func Test_initQueue_shutdown(t *testing.T) {
+	newPod := func(name string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "pod-queue-shutdown",
+				Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+					{Name: "serviceaccounts.cloud.google.com"}}}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	}
+
+	tests := []struct {
+		name         string
+		timeout      time.Duration
+		wantDrained  int
+		wantFinished bool
+	}{
+		{"in-flight and queued pods are drained", time.Minute, 2, true},
+		{"timeout", 10 * time.Millisecond, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inFlight, queued := newPod("in-flight"), newPod("queued")
+			store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+			assert.NoError(t, store.Add(inFlight))
+			assert.NoError(t, store.Add(queued))
+			clientset := newPatchingClientset(inFlight, queued)
+			patching, release := make(chan struct{}), make(chan struct{})
+			clientset.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				if action.(k8stesting.PatchAction).GetName() == "in-flight" {
+					patching <- struct{}{}
+					<-release
+				}
+				return false, nil, nil
+			})
+			q := newPodQueue(workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()), store, clientset)
+
+			q.enqueue(inFlight)
+			q.start(1)
+			<-patching
+			q.enqueue(queued)
+
+			go func() {
+				// Only let the patch finish once shutdown has begun.
+				for !q.queue.ShuttingDown() {
+					time.Sleep(time.Millisecond)
+				}
+				if tt.wantFinished {
+					close(release)
+				}
+			}()
+			drained, finished := q.shutdown(tt.timeout)
+			assert.Equal(t, tt.wantDrained, drained)
+			assert.Equal(t, tt.wantFinished, finished)
+			if !tt.wantFinished {
+				close(release)
+				return
+			}
+
+			for _, name := range []string{"in-flight", "queued"} {
+				got, err := clientset.CoreV1().Pods("pod-queue-shutdown").Get(name, metav1.GetOptions{})
+				assert.NoError(t, err)
+				assert.False(t, needsInitialization(got), "pod/%s is initialized", name)
+			}
+			q.queue.Add("pod-queue-shutdown/new")
+			assert.Equal(t, 0, q.queue.Len(), "no pod is accepted after shutdown")
+		})
+	}
+}
+
+func Test_initQueue_initialSyncPacing(t *testing.T) {
+	const qps, items = 50, 6
+	minElapsed := time.Duration(items-1) * time.Second / qps * 8 / 10
+
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	var pods []*corev1.Pod
+	var objs []runtime.Object
+	for i := 0; i < 2*items; i++ {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("pod-%d", i), Namespace: "initial-sync",
+				Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+					{Name: "serviceaccounts.cloud.google.com"}}}},
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+		assert.NoError(t, store.Add(pod))
+		pods = append(pods, pod)
+		objs = append(objs, pod)
+	}
+	q := newPodQueue(workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()), store, fake.NewSimpleClientset(objs...))
+	defer q.queue.ShutDown()
+	synced := false
+	q.limiter = flowcontrol.NewTokenBucketRateLimiter(qps, 1)
+	q.synced = func() bool { return synced }
+
+	// The informer has synced once it queued the backlog, before any of it
+	// is processed.
+	for _, pod := range pods[:items] {
+		q.enqueue(pod)
+	}
+	synced = true
+	start := time.Now()
+	for i := 0; i < items; i++ {
+		assert.True(t, q.processNext())
+	}
+	assert.True(t, time.Since(start) >= minElapsed,
+		"initial backlog took %v, want at least %v", time.Since(start), minElapsed)
+
+	for _, pod := range pods[items:] {
+		q.enqueue(pod)
+	}
+	start = time.Now()
+	for i := 0; i < items; i++ {
+		assert.True(t, q.processNext())
+	}
+	assert.True(t, time.Since(start) < minElapsed, "pods queued after the backlog are not paced")
+}
@@ -0,0 +1,48 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/ghodss/yaml"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// snippet holds the pod spec fragments the initializer would inject, for
+// users who prefer to add them to their manifests themselves.
+type snippet struct {
+	Volumes      []corev1.Volume      `json:"volumes"`
+	VolumeMounts []corev1.VolumeMount `json:"volumeMounts,omitempty"`
+	Env          []corev1.EnvVar      `json:"env,omitempty"`
+}
+
+// generateSnippet returns, as YAML, the volume, volume mount and env var
+// that modifyPodSpec injects for the given service account secret.
+func generateSnippet(serviceAccountName string) ([]byte, error) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "snippet",
+			Annotations: map[string]string{annotation: serviceAccountName}},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app"}}}}
+	if len(modifyPodSpec(pod)) == 0 {
+		return nil, fmt.Errorf("no injection generated for %q", serviceAccountName)
+	}
+
+	return yaml.Marshal(snippet{
+		Volumes:      pod.Spec.Volumes,
+		VolumeMounts: pod.Spec.Containers[0].VolumeMounts,
+		Env:          pod.Spec.Containers[0].Env,
+	})
+}
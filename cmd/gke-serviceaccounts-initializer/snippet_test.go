@@ -0,0 +1,44 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_generateSnippet(t *testing.T) {
+	out, err := generateSnippet("sa-1")
+	assert.NoError(t, err)
+
+	var got snippet
+	assert.NoError(t, yaml.Unmarshal(out, &got))
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "foo",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	assert.NotEmpty(t, modifyPodSpec(pod))
+
+	assert.Equal(t, pod.Spec.Volumes, got.Volumes)
+	assert.Equal(t, pod.Spec.Containers[0].VolumeMounts, got.VolumeMounts)
+	assert.Equal(t, pod.Spec.Containers[0].Env, got.Env)
+	assert.Contains(t, string(out), "secretName: sa-1")
+	assert.Contains(t, string(out), "mountPath: /var/run/secrets/gcp/sa-1")
+
+	_, err = generateSnippet("../../etc")
+	assert.Error(t, err)
+}
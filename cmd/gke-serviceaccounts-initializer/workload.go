@@ -0,0 +1,291 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	appsv1beta1 "k8s.io/api/apps/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// modifyPodTemplate injects the service account requested by the annotations
+// of a workload into its pod template. Returns whether any modifications
+// have been made.
+func modifyPodTemplate(obj metav1.Object, tmpl *corev1.PodTemplateSpec) bool {
+	pod := templatePod(obj, tmpl)
+
+	// A template already carrying the volume was injected before.
+	if name, ok := injectedVolume(pod); ok {
+		log.Printf("%s/%s already has volume %s", kindOf(obj), obj.GetName(), name)
+		return false
+	}
+
+	if len(modifyPodSpec(pod)) == 0 {
+		return false
+	}
+	obj.SetAnnotations(pod.ObjectMeta.Annotations)
+	tmpl.ObjectMeta.Labels = pod.ObjectMeta.Labels
+	tmpl.Spec = pod.Spec
+	return true
+}
+
+// templatePod returns a pod that is only a vehicle for modifyPodSpec: it
+// carries the workload's annotations and the template's labels and spec.
+func templatePod(obj metav1.Object, tmpl *corev1.PodTemplateSpec) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        obj.GetName(),
+			Namespace:   obj.GetNamespace(),
+			Annotations: obj.GetAnnotations(),
+			Labels:      tmpl.ObjectMeta.Labels},
+		Spec: tmpl.Spec}
+}
+
+// injectedVolume returns the name of the volume an earlier injection added to
+// the pod, if it carries one.
+func injectedVolume(pod *corev1.Pod) (string, bool) {
+	sa, ok := gcpServiceAccountFor(pod)
+	if !ok {
+		return "", false
+	}
+	name, err := volumeNameFor(pod, sa)
+	if err != nil || !hasVolume(pod.Spec, name) {
+		return "", false
+	}
+	return name, true
+}
+
+// hasVolume reports whether spec declares a volume with the given name.
+func hasVolume(spec corev1.PodSpec, name string) bool {
+	for _, v := range spec.Volumes {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// initializeWorkload injects the service account into tmpl, the pod template
+// of modified, a copy of the workload orig pending this initializer, and
+// removes the initializer from its pending list. The changes are saved with
+// save, given the strategic merge patch computed against dataStruct. It
+// returns an error if the workload is left pending and should be retried.
+// Initialized workloads that were injected before are handed to
+// reinjectWorkload instead.
+func initializeWorkload(orig, modified metav1.Object, tmpl *corev1.PodTemplateSpec,
+	dataStruct interface{}, save func(patch []byte) error) error {
+	kind := kindOf(orig)
+	object := kind + "/" + orig.GetName()
+	if shardFor(orig.GetUID(), *totalShards) != *shard {
+		return nil
+	}
+	if !needsInitialization(orig) {
+		if reinjectable(orig) {
+			return reinjectWorkload(orig, modified, tmpl, dataStruct, save)
+		}
+		workloadLogger(orig, "skip").Printf("skipping %s/%s", kind, orig.GetName())
+		return nil
+	}
+
+	sa, _ := gcpServiceAccountFor(templatePod(modified, tmpl))
+	injected := namespaceSelected(orig.GetNamespace()) && modifyPodTemplate(modified, tmpl)
+	if !injected {
+		workloadLogger(orig, "skip-injection").Printf("no injection in %s/%s", kind, orig.GetName())
+	}
+	removeSelfPendingInitializer(modified)
+
+	patch, err := createPatch(orig, modified, dataStruct)
+	if err == nil && *dryRun {
+		logDryRun(workloadLogger(orig, "dry-run"), object, patch)
+		recordDecision(orig, object, sa, decisionDryRun)
+		decisionsTotal.WithLabelValues(reasonDryRun).Inc()
+		if !*dryRunInitialize {
+			return nil
+		}
+		minimal := orig.(runtime.Object).DeepCopyObject().(metav1.Object)
+		removeSelfPendingInitializer(minimal)
+		patch, err = createPatch(orig, minimal, dataStruct)
+	}
+	if err == nil {
+		err = save(patch)
+	}
+	if err != nil {
+		workloadLogger(orig, "patch").Printf("error saving %s/%s: %+v", kind, orig.GetName(), err)
+		recordDecision(orig, object, sa, decisionFailed)
+		decisionsTotal.WithLabelValues(reasonPatchFailed).Inc()
+		return err
+	}
+	workloadLogger(orig, "initialize").Printf("initialized %s/%s", kind, orig.GetName())
+	if *dryRun {
+		return nil
+	}
+	if injected {
+		recordDecision(orig, object, sa, decisionInjected)
+		decisionsTotal.WithLabelValues(reasonInjected).Inc()
+	} else {
+		recordDecision(orig, object, "", decisionSkipped)
+		decisionsTotal.WithLabelValues(workloadSkipReason(orig, tmpl)).Inc()
+	}
+	return nil
+}
+
+// workloadSkipReason is skipReason for a workload left without injection,
+// which may also have been injected before.
+func workloadSkipReason(obj metav1.Object, tmpl *corev1.PodTemplateSpec) string {
+	pod := templatePod(obj, tmpl)
+	reason := skipReason(pod)
+	if reason == reasonInvalidAnnotation {
+		if _, ok := injectedVolume(pod); ok {
+			return reasonAlreadyInjected
+		}
+	}
+	return reason
+}
+
+// reinjectable reports whether obj is an initialized workload this
+// initializer injected before, as recorded by its version annotation, whose
+// pod template may have lost the injection since.
+func reinjectable(obj metav1.Object) bool {
+	if initializers := obj.GetInitializers(); initializers != nil && len(initializers.Pending) > 0 {
+		return false
+	}
+	_, injected := obj.GetAnnotations()[versionAnnotation]
+	return injected
+}
+
+// reinjectWorkload injects the service account again into tmpl, the pod
+// template of modified, a copy of the initialized workload orig, in case it
+// was removed out of band, e.g. by re-applying a manifest. Nothing is saved
+// if the template still carries the injection. Unlike pods, whose spec
+// cannot change once initialized, workloads roll the new template out.
+func reinjectWorkload(orig, modified metav1.Object, tmpl *corev1.PodTemplateSpec,
+	dataStruct interface{}, save func(patch []byte) error) error {
+	object := kindOf(orig) + "/" + orig.GetName()
+	before := tmpl.DeepCopy()
+	if !namespaceSelected(orig.GetNamespace()) || !modifyPodTemplate(modified, tmpl) ||
+		apiequality.Semantic.DeepEqual(before, tmpl) {
+		return nil
+	}
+
+	patch, err := createPatch(orig, modified, dataStruct)
+	if err == nil && *dryRun {
+		logDryRun(workloadLogger(orig, "dry-run"), object, patch)
+		return nil
+	}
+	if err == nil {
+		err = save(patch)
+	}
+	if err != nil {
+		workloadLogger(orig, "reinject").Printf("error re-injecting %s: %+v", object, err)
+		return err
+	}
+	workloadLogger(orig, "reinject").Printf("re-injected %s, its injection had been removed", object)
+	return nil
+}
+
+// workloadLogger returns a logger carrying the workload and the action being
+// logged as fields.
+func workloadLogger(obj metav1.Object, action string) *log.Entry {
+	return log.WithFields(log.Fields{
+		"kind":      kindOf(obj),
+		"name":      obj.GetName(),
+		"namespace": obj.GetNamespace(),
+		"action":    action})
+}
+
+// kindOf returns the lowercase kind of a pod or workload, for logging and
+// metric labels.
+func kindOf(obj metav1.Object) string {
+	switch obj.(type) {
+	case *corev1.Pod:
+		return "pod"
+	case *appsv1beta1.StatefulSet:
+		return "statefulset"
+	case *extensionsv1beta1.DaemonSet:
+		return "daemonset"
+	case *batchv1.Job:
+		return "job"
+	case *batchv1beta1.CronJob:
+		return "cronjob"
+	}
+	return "object"
+}
+
+// initializeAnyWorkload initializes a workload object returned by one of the
+// workload informers.
+func initializeAnyWorkload(obj interface{}, clientset kubernetes.Interface) error {
+	switch w := obj.(type) {
+	case *appsv1beta1.StatefulSet:
+		return initializeStatefulSet(w, clientset)
+	case *extensionsv1beta1.DaemonSet:
+		return initializeDaemonSet(w, clientset)
+	case *batchv1.Job:
+		return initializeJob(w, clientset)
+	case *batchv1beta1.CronJob:
+		return initializeCronJob(w, clientset)
+	}
+	log.Fatalf("watch returned non-workload object: %T", obj)
+	return nil
+}
+
+// initializeStatefulSet initializes the pod template of a StatefulSet.
+func initializeStatefulSet(ss *appsv1beta1.StatefulSet, clientset kubernetes.Interface) error {
+	modified := ss.DeepCopy()
+	return initializeWorkload(ss, modified, &modified.Spec.Template, appsv1beta1.StatefulSet{},
+		func(patch []byte) error {
+			_, err := clientset.AppsV1beta1().StatefulSets(ss.GetNamespace()).Patch(
+				ss.GetName(), types.StrategicMergePatchType, patch)
+			return err
+		})
+}
+
+// initializeDaemonSet initializes the pod template of a DaemonSet.
+func initializeDaemonSet(ds *extensionsv1beta1.DaemonSet, clientset kubernetes.Interface) error {
+	modified := ds.DeepCopy()
+	return initializeWorkload(ds, modified, &modified.Spec.Template, extensionsv1beta1.DaemonSet{},
+		func(patch []byte) error {
+			_, err := clientset.ExtensionsV1beta1().DaemonSets(ds.GetNamespace()).Patch(
+				ds.GetName(), types.StrategicMergePatchType, patch)
+			return err
+		})
+}
+
+// initializeJob initializes the pod template of a Job.
+func initializeJob(job *batchv1.Job, clientset kubernetes.Interface) error {
+	modified := job.DeepCopy()
+	return initializeWorkload(job, modified, &modified.Spec.Template, batchv1.Job{},
+		func(patch []byte) error {
+			_, err := clientset.BatchV1().Jobs(job.GetNamespace()).Patch(
+				job.GetName(), types.StrategicMergePatchType, patch)
+			return err
+		})
+}
+
+// initializeCronJob initializes the pod template of the jobs a CronJob
+// creates.
+func initializeCronJob(cj *batchv1beta1.CronJob, clientset kubernetes.Interface) error {
+	modified := cj.DeepCopy()
+	return initializeWorkload(cj, modified, &modified.Spec.JobTemplate.Spec.Template, batchv1beta1.CronJob{},
+		func(patch []byte) error {
+			_, err := clientset.BatchV1beta1().CronJobs(cj.GetNamespace()).Patch(
+				cj.GetName(), types.StrategicMergePatchType, patch)
+			return err
+		})
+}
@@ -0,0 +1,323 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	appsv1beta1 "k8s.io/api/apps/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func Test_initializeStatefulSet(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantVolumes int
+	}{
+		{"annotated", map[string]string{"iam.cloud.google.com/service-account": "sa-1"}, 1},
+		{"not annotated", nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ss := &appsv1beta1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default",
+					Annotations: tt.annotations,
+					Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+						{Name: "serviceaccounts.cloud.google.com"}}}},
+				Spec: appsv1beta1.StatefulSetSpec{
+					Template: corev1.PodTemplateSpec{
+						Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}}}
+			clientset := newPatchingClientset(ss)
+
+			initializeStatefulSet(ss, clientset)
+
+			got, err := clientset.AppsV1beta1().StatefulSets("default").Get("db", metav1.GetOptions{})
+			assert.NoError(t, err)
+			assert.False(t, needsInitialization(got))
+			spec := got.Spec.Template.Spec
+			assert.Len(t, spec.Volumes, tt.wantVolumes)
+			if tt.wantVolumes > 0 {
+				assert.Equal(t, "gcp-sa-1", spec.Volumes[0].Name)
+				assert.Equal(t, []corev1.EnvVar{{
+					Name:  "GOOGLE_APPLICATION_CREDENTIALS",
+					Value: "/var/run/secrets/gcp/sa-1/key.json"}}, spec.Containers[0].Env)
+			}
+		})
+	}
+}
+
+func Test_initializeDaemonSet(t *testing.T) {
+	defer func(v bool) { *injectAllContainers = v }(*injectAllContainers)
+	*injectAllContainers = true
+	newDaemonSet := func(volumes []corev1.Volume) *extensionsv1beta1.DaemonSet {
+		return &extensionsv1beta1.DaemonSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "default",
+				Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+				Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+					{Name: "serviceaccounts.cloud.google.com"}}}},
+			Spec: extensionsv1beta1.DaemonSetSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						Volumes: volumes,
+						Containers: []corev1.Container{
+							{Name: "c1", Image: "i1"},
+							{Name: "c2", Image: "i2"}}}}}}
+	}
+
+	t.Run("every container is injected", func(t *testing.T) {
+		ds := newDaemonSet(nil)
+		clientset := newPatchingClientset(ds)
+		initializeDaemonSet(ds, clientset)
+
+		got, err := clientset.ExtensionsV1beta1().DaemonSets("default").Get("agent", metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.False(t, needsInitialization(got))
+		spec := got.Spec.Template.Spec
+		assert.Len(t, spec.Volumes, 1)
+		for _, c := range spec.Containers {
+			assert.Len(t, c.VolumeMounts, 1, "container %s", c.Name)
+			assert.Len(t, c.Env, 1, "container %s", c.Name)
+		}
+	})
+
+	t.Run("existing volume is a no-op", func(t *testing.T) {
+		volumes := []corev1.Volume{{Name: "gcp-sa-1"}}
+		ds := newDaemonSet(volumes)
+		clientset := newPatchingClientset(ds)
+		initializeDaemonSet(ds, clientset)
+
+		got, err := clientset.ExtensionsV1beta1().DaemonSets("default").Get("agent", metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.False(t, needsInitialization(got))
+		assert.Equal(t, volumes, got.Spec.Template.Spec.Volumes)
+		assert.Empty(t, got.Spec.Template.Spec.Containers[0].VolumeMounts)
+	})
+}
+
+func Test_initializeAnyWorkload_batch(t *testing.T) {
+	meta := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: name, Namespace: "default",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+			Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+				{Name: "serviceaccounts.cloud.google.com"}}}}
+	}
+	template := corev1.PodTemplateSpec{
+		Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+	job := &batchv1.Job{ObjectMeta: meta("job"),
+		Spec: batchv1.JobSpec{Template: template}}
+	cj := &batchv1beta1.CronJob{ObjectMeta: meta("cronjob"),
+		Spec: batchv1beta1.CronJobSpec{JobTemplate: batchv1beta1.JobTemplateSpec{
+			Spec: batchv1.JobSpec{Template: template}}}}
+	clientset := newPatchingClientset(job, cj)
+
+	initializeAnyWorkload(job, clientset)
+	initializeAnyWorkload(cj, clientset)
+
+	gotJob, err := clientset.BatchV1().Jobs("default").Get("job", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.False(t, needsInitialization(gotJob))
+	assert.Len(t, gotJob.Spec.Template.Spec.Volumes, 1)
+	assert.Len(t, gotJob.Spec.Template.Spec.Containers[0].Env, 1)
+
+	gotCronJob, err := clientset.BatchV1beta1().CronJobs("default").Get("cronjob", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.False(t, needsInitialization(gotCronJob))
+	spec := gotCronJob.Spec.JobTemplate.Spec.Template.Spec
+	assert.Len(t, spec.Volumes, 1)
+	assert.Len(t, spec.Containers[0].Env, 1)
+}
+
+func Test_modifyPodTemplate_jobExpiryMonitor(t *testing.T) {
+	defer func(v string) { *expiryMonitorImage = v }(*expiryMonitorImage)
+	*expiryMonitorImage = "gcr.io/example/key-expiry:v1"
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "job", Namespace: "default",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"}},
+		Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{
+			Spec: corev1.PodSpec{
+				RestartPolicy: corev1.RestartPolicyNever,
+				Containers:    []corev1.Container{{Name: "c1", Image: "i1"}}}}}}
+	assert.True(t, modifyPodTemplate(job, &job.Spec.Template))
+	assert.Len(t, job.Spec.Template.Spec.Volumes, 1)
+	assert.Len(t, job.Spec.Template.Spec.Containers, 1, "a sidecar would keep the job from completing")
+}
+
+func Test_legacyAnnotation(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        string
+	}{
+		{"current key", map[string]string{"iam.cloud.google.com/service-account": "sa-1"}, "gcp-sa-1"},
+		{"legacy key", map[string]string{"iam.cloud.google.com/account-name": "sa-1"}, "gcp-sa-1"},
+		{"current key wins", map[string]string{
+			"iam.cloud.google.com/service-account": "sa-1",
+			"iam.cloud.google.com/account-name":    "sa-old"}, "gcp-sa-1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "foo", Annotations: copyMap(tt.annotations)},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}
+			assert.NotEmpty(t, modifyPodSpec(pod))
+			assert.Equal(t, tt.want, pod.Spec.Volumes[0].Name, "pod path")
+
+			ss := &appsv1beta1.StatefulSet{
+				ObjectMeta: metav1.ObjectMeta{Name: "db", Annotations: copyMap(tt.annotations)},
+				Spec: appsv1beta1.StatefulSetSpec{Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}}}
+			assert.True(t, modifyPodTemplate(ss, &ss.Spec.Template))
+			assert.Equal(t, tt.want, ss.Spec.Template.Spec.Volumes[0].Name, "workload path")
+		})
+	}
+}
+
+func copyMap(m map[string]string) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+func Test_initializeStatefulSet_emptyTemplate(t *testing.T) {
+	ss := &appsv1beta1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "default",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+			Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+				{Name: "serviceaccounts.cloud.google.com"}}}}}
+	clientset := newPatchingClientset(ss)
+
+	assert.NotPanics(t, func() { initializeStatefulSet(ss, clientset) })
+
+	got, err := clientset.AppsV1beta1().StatefulSets("default").Get("db", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.False(t, needsInitialization(got))
+	assert.Empty(t, got.Spec.Template.Spec.Volumes, "nothing to inject without containers")
+}
+
+func Test_initializeJob_dryRun(t *testing.T) {
+	defer func(v bool) { *dryRun = v }(*dryRun)
+	*dryRun = true
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "backup", Namespace: "default",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+			Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+				{Name: "serviceaccounts.cloud.google.com"}}}},
+		Spec: batchv1.JobSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}}}
+	clientset := newPatchingClientset(job)
+
+	initializeJob(job, clientset)
+
+	got, err := clientset.BatchV1().Jobs("default").Get("backup", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.False(t, needsInitialization(got))
+	assert.Empty(t, got.Spec.Template.Spec.Volumes, "dry run must not inject")
+	assert.NotNil(t, job.GetInitializers(), "the informer's copy must not be modified")
+}
+
+func Test_workloadQueue(t *testing.T) {
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{Name: "job", Namespace: "workload-queue",
+			Annotations: map[string]string{"iam.cloud.google.com/service-account": "sa-1"},
+			Initializers: &metav1.Initializers{Pending: []metav1.Initializer{
+				{Name: "serviceaccounts.cloud.google.com"}}}},
+		Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{
+			Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}}}
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	assert.NoError(t, store.Add(job))
+	clientset := newPatchingClientset(job)
+	fail := true
+	clientset.PrependReactor("patch", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if fail {
+			return true, nil, apierrors.NewServiceUnavailable("unavailable")
+		}
+		return false, nil, nil
+	})
+	// Requeued workloads are never due during the test.
+	q := newWorkloadQueue(workqueue.NewRateLimitingQueue(workqueue.NewItemExponentialFailureRateLimiter(time.Hour, time.Hour)), store, clientset)
+	defer q.queue.ShutDown()
+
+	q.enqueue(job)
+	assert.True(t, q.processNext())
+	assert.Equal(t, 1, q.queue.NumRequeues("workload-queue/job"), "failed workload is requeued")
+
+	fail = false
+	q.queue.Forget("workload-queue/job")
+	q.enqueue(job)
+	assert.True(t, q.processNext())
+	assert.Equal(t, 0, q.queue.NumRequeues("workload-queue/job"))
+	got, err := clientset.BatchV1().Jobs("workload-queue").Get("job", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.False(t, needsInitialization(got))
+	assert.Len(t, got.Spec.Template.Spec.Volumes, 1)
+}
+
+func Test_workloadQueue_reconcile(t *testing.T) {
+	newStatefulSet := func(name string, annotations map[string]string) *appsv1beta1.StatefulSet {
+		return &appsv1beta1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "workload-reconcile", Annotations: annotations},
+			Spec: appsv1beta1.StatefulSetSpec{Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "c1", Image: "i1"}}}}}}
+	}
+	injected := map[string]string{
+		"iam.cloud.google.com/service-account":  "sa-1",
+		"iam.cloud.google.com/injector-version": "dev"}
+	// The injection was removed from the template out of band.
+	lost := newStatefulSet("lost", injected)
+	intact := newStatefulSet("intact", injected)
+	assert.True(t, modifyPodTemplate(intact, &intact.Spec.Template))
+	// Annotated after it was initialized, so never injected.
+	neverInjected := newStatefulSet("never-injected",
+		map[string]string{"iam.cloud.google.com/service-account": "sa-1"})
+
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+	for _, ss := range []*appsv1beta1.StatefulSet{lost, intact, neverInjected} {
+		assert.NoError(t, store.Add(ss))
+	}
+	clientset := newPatchingClientset(lost, intact, neverInjected)
+	var patched []string
+	clientset.PrependReactor("patch", "statefulsets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patched = append(patched, action.(k8stesting.PatchAction).GetName())
+		return false, nil, nil
+	})
+	q := newWorkloadQueue(workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()), store, clientset)
+	defer q.queue.ShutDown()
+
+	q.reconcile()
+	assert.Equal(t, 2, q.queue.Len(), "only injected workloads are reconciled")
+	for q.queue.Len() > 0 {
+		assert.True(t, q.processNext())
+	}
+	assert.Equal(t, []string{"lost"}, patched, "workloads that kept the injection are not patched")
+
+	got, err := clientset.AppsV1beta1().StatefulSets("workload-reconcile").Get("lost", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, got.Spec.Template.Spec.Volumes, 1)
+	assert.Len(t, got.Spec.Template.Spec.Containers[0].VolumeMounts, 1)
+}